@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/gomidi/midi/v2"
+)
+
+// Prefix of the WebSocket subprotocol with the base64url encoded API key,
+// as browsers can not set headers on WebSockets.
+const apiKeyProtocolPrefix = "api-key."
+
+// Get the API key of a request, from a bearer token, the X-API-Key header, or a WebSocket subprotocol.
+// Keys are never read from the URL, as URLs are written to access logs and browser history.
+func requestAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if header := r.Header.Get("X-API-Key"); header != "" {
+		return header
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if encoded, ok := strings.CutPrefix(protocol, apiKeyProtocolPrefix); ok {
+			key, err := base64.RawURLEncoding.DecodeString(encoded)
+			if err == nil {
+				return string(key)
+			}
+		}
+	}
+	return ""
+}
+
+// Require the API key, if one is configured.
+func (s *HTTPServer) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.APIKey != "" {
+			key := requestAPIKey(r)
+			if subtle.ConstantTimeCompare([]byte(key), []byte(s.config.APIKey)) != 1 {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// MIDI device available to connect to.
+type APIDevice struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+}
+
+// MIDI devices available to connect to.
+type APIDevices struct {
+	In  []APIDevice `json:"in"`
+	Out []APIDevice `json:"out"`
+}
+
+// Lists the MIDI in and out devices currently available.
+func (s *HTTPServer) DevicesHandler(w http.ResponseWriter, r *http.Request) {
+	devices := APIDevices{
+		In:  []APIDevice{},
+		Out: []APIDevice{},
+	}
+	for _, port := range midi.GetInPorts() {
+		devices.In = append(devices.In, APIDevice{Index: port.Number(), Name: port.String()})
+	}
+	for _, port := range midi.GetOutPorts() {
+		devices.Out = append(devices.Out, APIDevice{Index: port.Number(), Name: port.String()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// Responds with the configuration loaded, including defaults, with secrets redacted.
+func (s *HTTPServer) ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.Config())
+}
+
+// Find the router with the name.
+func findRouter(name string) *MidiRouter {
+	for _, router := range app.Config().MidiRouters {
+		if router.Name == name {
+			return router
+		}
+	}
+	return nil
+}
+
+// Sends the MIDI message in the request body to the output device of a router.
+func (s *HTTPServer) SendHandler(w http.ResponseWriter, r *http.Request) {
+	router := findRouter(mux.Vars(r)["router"])
+	if router == nil {
+		http.Error(w, "router not found", http.StatusNotFound)
+		return
+	}
+	if !router.beginWork() {
+		http.Error(w, errDisconnecting.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer router.inFlight.Done()
+
+	// Read the message to send.
+	payload := MQTTPayload{channelBase: router.ChannelDisplayBase}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize)).Decode(&payload)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "invalid message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !payload.Type.IsValid() {
+		http.Error(w, "unsupported message type: "+string(payload.Type), http.StatusBadRequest)
+		return
+	}
+	if err := payload.CheckRange(); err != nil {
+		http.Error(w, "invalid message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Send MIDI message.
+	fields := log.Fields{"uri": r.URL.Path}
+	err = router.sendMidi(payload.MidiMessage())
+	if errors.Is(err, errMidiOutNotConnected) {
+		router.logSendError(fields, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		router.logSendError(fields, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	router.LogWithFields(SendLog, payload.Fields(), "-> [MIDI] %s", payload)
+	triggersTotal.WithLabelValues(router.Name, "api").Inc()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sends all notes off on every channel of the named router, to silence hanging notes.
+func (s *HTTPServer) PanicHandler(w http.ResponseWriter, r *http.Request) {
+	router := findRouter(mux.Vars(r)["router"])
+	if router == nil {
+		http.Error(w, "router not found", http.StatusNotFound)
+		return
+	}
+	if !router.beginWork() {
+		http.Error(w, errDisconnecting.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer router.inFlight.Done()
+
+	fields := log.Fields{"uri": r.URL.Path}
+	err := router.sendPanic()
+	if errors.Is(err, errMidiOutNotConnected) {
+		router.logSendError(fields, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		router.logSendError(fields, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
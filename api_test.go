@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticated(t *testing.T) {
+	tests := []struct {
+		name   string
+		apiKey string
+		target string
+		header http.Header
+		status int
+	}{
+		{name: "without api key", target: "/api/devices", status: http.StatusOK},
+		{name: "bearer token", apiKey: "secret", target: "/api/devices", header: http.Header{"Authorization": {"Bearer secret"}}, status: http.StatusOK},
+		{name: "api key header", apiKey: "secret", target: "/api/devices", header: http.Header{"X-Api-Key": {"secret"}}, status: http.StatusOK},
+		{name: "websocket subprotocol", apiKey: "secret", target: "/ws/test", header: http.Header{"Sec-Websocket-Protocol": {streamProtocol + ", " + apiKeyProtocolPrefix + base64.RawURLEncoding.EncodeToString([]byte("secret"))}}, status: http.StatusOK},
+		{name: "wrong key", apiKey: "secret", target: "/api/devices", header: http.Header{"X-Api-Key": {"other"}}, status: http.StatusUnauthorized},
+		{name: "missing key", apiKey: "secret", target: "/api/devices", status: http.StatusUnauthorized},
+		{name: "query value", apiKey: "secret", target: "/api/devices?api_key=secret", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &HTTPServer{config: &HTTPConfig{APIKey: tt.apiKey}}
+			handler := s.authenticated(func(w http.ResponseWriter, r *http.Request) {})
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header = tt.header.Clone()
+			if req.Header == nil {
+				req.Header = make(http.Header)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -1,17 +1,28 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kkyr/fig"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/natefinch/lumberjack.v2"
+	"gopkg.in/yaml.v3"
 )
 
 // Configurations relating to HTTP server.
@@ -21,6 +32,60 @@ type HTTPConfig struct {
 	Debug    bool   `fig:"debug"`
 	APIKey   string `fig:"api_key"`
 	Enabled  bool   `fig:"enabled"`
+	// Networks allowed to make requests, such as `192.168.1.0/24`, or all if empty.
+	AllowedCIDRs []string `fig:"allowed_cidrs"`
+	// Header set by a trusted proxy with the client address, such as `X-Forwarded-For`.
+	TrustedProxyHeader string `fig:"trusted_proxy_header"`
+	// Networks of the proxies trusted to set the proxy header, which is ignored from other addresses.
+	TrustedProxyCIDRs []string `fig:"trusted_proxy_cidrs"`
+	// Network to listen on, either tcp for IPv4 and IPv6, tcp4, or tcp6.
+	Network string `fig:"network" default:"tcp"`
+	// How long to wait for requests to complete on shutdown before closing connections.
+	ShutdownTimeout time.Duration `fig:"shutdown_timeout" default:"10s"`
+	// Requests per second allowed to trigger endpoints, or unlimited if 0.
+	RateLimit float64 `fig:"rate_limit"`
+	// Requests allowed in a burst above the rate limit, defaulting to the rate limit.
+	RateBurst int `fig:"rate_burst"`
+}
+
+// Encode the config with the API key redacted.
+func (c HTTPConfig) MarshalJSON() ([]byte, error) {
+	type config HTTPConfig
+	c.APIKey = redact(c.APIKey)
+	return json.Marshal(config(c))
+}
+
+// Replacement for secrets in encoded configs.
+const redactedSecret = "********"
+
+// Redact a secret, leaving empty values empty so it is clear they are not set.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedSecret
+}
+
+// Headers which carry credentials, redacted in encoded configs.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key", "X-Auth-Token"}
+
+// Copy headers with the values of credential headers redacted.
+func redactHeader(src http.Header) http.Header {
+	if src == nil {
+		return nil
+	}
+	header := make(http.Header, len(src))
+	for key, values := range src {
+		if slices.Contains(credentialHeaders, http.CanonicalHeaderKey(key)) {
+			redacted := make([]string, len(values))
+			for i, value := range values {
+				redacted[i] = redact(value)
+			}
+			values = redacted
+		}
+		header[key] = values
+	}
+	return header
 }
 
 // Configuration for logging.
@@ -46,6 +111,12 @@ type LogConfig struct {
 	Compress *bool `fig:"compress" yaml:"compress" default:"true"`
 }
 
+// Log files of the outputs applied, closed when the outputs are replaced.
+var (
+	logFiles   []*lumberjack.Logger
+	logFilesMu sync.Mutex
+)
+
 // Apply log config.
 func (l *LogConfig) Apply() {
 	// Apply level.
@@ -137,6 +208,19 @@ func (l *LogConfig) Apply() {
 	if len(outputs) != 0 {
 		mw := io.MultiWriter(outputs...)
 		log.SetOutput(mw)
+
+		// Close the files of the previous outputs, so reapplying does not leak them.
+		logFilesMu.Lock()
+		defer logFilesMu.Unlock()
+		for _, logFile := range logFiles {
+			logFile.Close()
+		}
+		logFiles = nil
+		for _, output := range outputs {
+			if logFile, ok := output.(*lumberjack.Logger); ok {
+				logFiles = append(logFiles, logFile)
+			}
+		}
 	}
 }
 
@@ -147,8 +231,223 @@ type Config struct {
 	MidiRouters []*MidiRouter `fig:"midi_routers"`
 }
 
-// Load the configuration.
-func (a *App) ReadConfig() {
+// Matches environment variable references, such as `${MQTT_PASSWORD}`.
+var envVarRx = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// Replace environment variable references in the string, leaving other text untouched.
+func expandEnv(s string) string {
+	return envVarRx.ReplaceAllStringFunc(s, func(ref string) string {
+		return os.Getenv(envVarRx.FindStringSubmatch(ref)[1])
+	})
+}
+
+// Expand environment variable references in secrets and connection settings.
+func (c *Config) ExpandEnv() {
+	c.HTTP.APIKey = expandEnv(c.HTTP.APIKey)
+	for _, router := range c.MidiRouters {
+		router.MQTT.Host = expandEnv(router.MQTT.Host)
+		router.MQTT.User = expandEnv(router.MQTT.User)
+		router.MQTT.Password = expandEnv(router.MQTT.Password)
+		for i := range router.NoteTriggers {
+			trig := &router.NoteTriggers[i]
+			trig.BasicAuthUser = expandEnv(trig.BasicAuthUser)
+			trig.BasicAuthPassword = expandEnv(trig.BasicAuthPassword)
+			trig.BearerToken = expandEnv(trig.BearerToken)
+		}
+	}
+}
+
+// Check the configuration for problems which would prevent it from working.
+func (c *Config) Validate() error {
+	var errs []error
+	switch c.HTTP.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		errs = append(errs, fmt.Errorf("http: unsupported network: %s", c.HTTP.Network))
+	}
+	if c.HTTP.RateLimit < 0 || c.HTTP.RateBurst < 0 {
+		errs = append(errs, fmt.Errorf("http: rate limit and burst can not be negative"))
+	}
+	if _, err := parseCIDRs(c.HTTP.AllowedCIDRs); err != nil {
+		errs = append(errs, fmt.Errorf("http: %v", err))
+	}
+	if _, err := parseCIDRs(c.HTTP.TrustedProxyCIDRs); err != nil {
+		errs = append(errs, fmt.Errorf("http: trusted proxy %v", err))
+	}
+	if c.HTTP.TrustedProxyHeader != "" && len(c.HTTP.TrustedProxyCIDRs) == 0 {
+		errs = append(errs, fmt.Errorf("http: trusted proxy header requires the trusted proxy cidrs"))
+	}
+	for i, router := range c.MidiRouters {
+		name := router.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+
+		// Verify the device regular expression compiles.
+		if !router.VirtualPort {
+			if _, err := router.deviceRegexp(); err != nil {
+				errs = append(errs, fmt.Errorf("router %s: invalid device regexp '%s': %v", name, router.Device, err))
+			}
+		}
+
+		// Verify a topic is set when connecting to a broker.
+		if router.MQTT.Host != "" && router.MQTT.Topic == "" {
+			errs = append(errs, fmt.Errorf("router %s: mqtt topic is required when a host is set", name))
+		}
+		for _, topic := range []string{router.MQTT.Topic, router.MQTT.AvailabilityTopic} {
+			if strings.ContainsAny(topic, "+#") {
+				errs = append(errs, fmt.Errorf("router %s: mqtt topic '%s' can not contain the wildcards + or #", name, topic))
+			}
+		}
+		switch router.MQTT.Scheme {
+		case "", "tcp", "ssl", "ws", "wss":
+		default:
+			errs = append(errs, fmt.Errorf("router %s: unsupported mqtt scheme: %s", name, router.MQTT.Scheme))
+		}
+		if router.MQTT.QoS > 2 {
+			errs = append(errs, fmt.Errorf("router %s: mqtt qos must be 0, 1, or 2", name))
+		}
+
+		// Verify the OSC addresses.
+		if router.OSC.SendAddress != "" {
+			if _, _, err := router.OSC.SendHostPort(); err != nil {
+				errs = append(errs, fmt.Errorf("router %s: invalid osc send address '%s': %v", name, router.OSC.SendAddress, err))
+			}
+		}
+		if !strings.HasPrefix(router.OSC.Prefix, "/") {
+			errs = append(errs, fmt.Errorf("router %s: osc prefix must start with /", name))
+		}
+		for j, trig := range router.RequestTriggers {
+			if trig.OscAddress != "" && !strings.HasPrefix(trig.OscAddress, "/") {
+				errs = append(errs, fmt.Errorf("router %s: request trigger %d osc address must start with /", name, j))
+			}
+		}
+
+		// Verify note trigger templates and regular expressions parse.
+		for j := range router.NoteTriggers {
+			if err := router.NoteTriggers[j].ParseTemplates(); err != nil {
+				errs = append(errs, fmt.Errorf("router %s: note trigger %d %v", name, j, err))
+			}
+		}
+
+		// Verify notes are MIDI notes, as numbers are decoded up to 255, and the ranges of notes and velocities are not empty.
+		for j, trig := range router.NoteTriggers {
+			for _, note := range []struct {
+				key   string
+				value NoteNumber
+			}{
+				{"note", trig.Note},
+				{"note min", trig.NoteMin},
+				{"note max", trig.NoteMax},
+			} {
+				if note.value > maxMidiValue {
+					errs = append(errs, fmt.Errorf("router %s: note trigger %d %s must be 0 to %d", name, j, note.key, maxMidiValue))
+				}
+			}
+			if trig.OutputNote != nil && *trig.OutputNote > maxMidiValue {
+				errs = append(errs, fmt.Errorf("router %s: note trigger %d output note must be 0 to %d", name, j, maxMidiValue))
+			}
+			if trig.NoteMax != 0 && trig.NoteMin > trig.NoteMax {
+				errs = append(errs, fmt.Errorf("router %s: note trigger %d note min can not be above note max", name, j))
+			}
+			if trig.VelocityMax != 0 && trig.VelocityMin > trig.VelocityMax {
+				errs = append(errs, fmt.Errorf("router %s: note trigger %d velocity min can not be above velocity max", name, j))
+			}
+		}
+
+		// Verify the MIDI info sent by request triggers and their sequences is in range, as numbers are decoded up to 255.
+		for j, trig := range router.RequestTriggers {
+			if err := trig.Payload().CheckRange(); err != nil {
+				errs = append(errs, fmt.Errorf("router %s: request trigger %d %v", name, j, err))
+			}
+			for k, spec := range trig.Sequence {
+				if err := spec.Payload().CheckRange(); err != nil {
+					errs = append(errs, fmt.Errorf("router %s: request trigger %d sequence %d %v", name, j, k, err))
+				}
+			}
+		}
+
+		// Verify velocity scales.
+		for j, trig := range router.NoteTriggers {
+			if err := trig.VelocityScale.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("router %s: note trigger %d %v", name, j, err))
+			}
+		}
+		for j, trig := range router.RequestTriggers {
+			if err := trig.VelocityScale.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("router %s: request trigger %d %v", name, j, err))
+			}
+		}
+
+		if router.ChannelDisplayBase > 1 {
+			errs = append(errs, fmt.Errorf("router %s: channel display base must be 0 or 1", name))
+		}
+
+		for j, trig := range router.NoteTriggers {
+			if strings.ContainsAny(trig.ResponseToMqttTopic, "+#") {
+				errs = append(errs, fmt.Errorf("router %s: note trigger %d response topic can not contain wildcards", name, j))
+			}
+		}
+
+		// Verify the note topic map entries.
+		for j, entry := range router.NoteTopicMap {
+			if entry.Topic == "" || strings.ContainsAny(entry.Topic, "+#") {
+				errs = append(errs, fmt.Errorf("router %s: note topic map %d needs a topic without wildcards", name, j))
+			}
+			if entry.Channel != nil && *entry.Channel > 15 {
+				errs = append(errs, fmt.Errorf("router %s: note topic map %d channel must be 0 to 15", name, j))
+			}
+		}
+
+		// Verify output channels are valid MIDI channels.
+		for j, trig := range router.NoteTriggers {
+			if trig.OutputChannel != nil && *trig.OutputChannel > 15 {
+				errs = append(errs, fmt.Errorf("router %s: note trigger %d output channel must be 0 to 15", name, j))
+			}
+		}
+		for j, trig := range router.RequestTriggers {
+			if trig.OutputChannel != nil && *trig.OutputChannel > 15 {
+				errs = append(errs, fmt.Errorf("router %s: request trigger %d output channel must be 0 to 15", name, j))
+			}
+		}
+
+		// Verify message types are supported, as unknown types would otherwise be handled as notes.
+		for j, trig := range router.NoteTriggers {
+			if !trig.MessageType.IsValid() {
+				errs = append(errs, fmt.Errorf("router %s: note trigger %d unsupported message type: %s", name, j, trig.MessageType))
+			}
+		}
+		for j, trig := range router.RequestTriggers {
+			if !trig.MessageType.IsValid() {
+				errs = append(errs, fmt.Errorf("router %s: request trigger %d unsupported message type: %s", name, j, trig.MessageType))
+			}
+		}
+
+		// Verify system exclusive values decode.
+		for j, trig := range router.NoteTriggers {
+			if _, err := hex.DecodeString(strings.ReplaceAll(trig.SysExPrefix, " ", "")); err != nil {
+				errs = append(errs, fmt.Errorf("router %s: note trigger %d invalid sysex prefix: %v", name, j, err))
+			}
+		}
+		for j, trig := range router.RequestTriggers {
+			if _, err := decodeSysExHex(trig.SysEx); err != nil {
+				errs = append(errs, fmt.Errorf("router %s: request trigger %d %v", name, j, err))
+			}
+			for k, spec := range trig.Sequence {
+				if !spec.MessageType.IsValid() {
+					errs = append(errs, fmt.Errorf("router %s: request trigger %d sequence %d unsupported message type: %s", name, j, k, spec.MessageType))
+				}
+				if _, err := decodeSysExHex(spec.SysEx); err != nil {
+					errs = append(errs, fmt.Errorf("router %s: request trigger %d sequence %d %v", name, j, k, err))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Find the configuration file to use, returning the paths searched if none is found.
+func (a *App) ConfigFile() (string, []string) {
 	usr, err := user.Current()
 	if err != nil {
 		log.Fatal(err)
@@ -158,19 +457,214 @@ func (a *App) ReadConfig() {
 	localConfig, _ := filepath.Abs("./config.yaml")
 	homeDirConfig := usr.HomeDir + "/.config/midi-request-trigger/config.yaml"
 	etcConfig := "/etc/midi-request-trigger/config.yaml"
+	paths := []string{localConfig, homeDirConfig, etcConfig}
+	if isRemoteConfig(app.flags.ConfigPath) {
+		return app.flags.ConfigPath, nil
+	}
+	if app.flags.ConfigPath != "" {
+		if _, err := os.Stat(app.flags.ConfigPath); err != nil {
+			log.Printf("Unable to read configuration file %s: %s\n", app.flags.ConfigPath, err)
+		}
+		paths = append([]string{app.flags.ConfigPath}, paths...)
+	}
+
+	// Use the first configuration which exists.
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", paths
+}
 
+// Error returned when no configuration file is found, so the defaults are used.
+var errConfigNotFound = errors.New("no configuration file found")
+
+// Timeout of fetching the configuration from a URL.
+const configFetchTimeout = 30 * time.Second
+
+// Check if the configuration path is stdin or a URL rather than a file.
+func isRemoteConfig(configPath string) bool {
+	return configPath == "-" || strings.HasPrefix(configPath, "http://") || strings.HasPrefix(configPath, "https://")
+}
+
+// Read the configuration from stdin or a URL.
+func (a *App) readRemoteConfig(configPath string) ([]byte, error) {
+	if configPath == "-" {
+		if a.stdinConfig == nil {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read configuration from stdin: %v", err)
+			}
+			a.stdinConfig = data
+		}
+		return a.stdinConfig, nil
+	}
+
+	client := &http.Client{Timeout: configFetchTimeout}
+	res, err := client.Get(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch configuration: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch configuration: %s responded with %s", configPath, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// Write the configuration from stdin or a URL to a temporary file for loading,
+// keeping the extension of the URL so the format is detected, or YAML by default.
+// The returned function removes the file.
+func (a *App) writeRemoteConfig(configPath string) (string, func(), error) {
+	data, err := a.readRemoteConfig(configPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ext := ".yaml"
+	if u, err := url.Parse(configPath); err == nil && configPath != "-" {
+		switch e := path.Ext(u.Path); e {
+		case ".json", ".toml", ".yml":
+			ext = e
+		}
+	}
+	f, err := os.CreateTemp("", serviceName+"-*"+ext)
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.Remove(f.Name()) }
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return f.Name(), cleanup, nil
+}
+
+// Load the routers of each YAML file in the directory, in order of file name.
+// HTTP and log settings may only be set in the base configuration.
+func loadConfigDir(dir string) ([]*MidiRouter, error) {
+	var files []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	slices.Sort(files)
+
+	var routers []*MidiRouter
+	for _, file := range files {
+		// Check for settings which conflict with the base configuration.
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var keys map[string]any
+		err = yaml.Unmarshal(data, &keys)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		for _, key := range []string{"http", "log"} {
+			if _, ok := keys[key]; ok {
+				return nil, fmt.Errorf("%s: %s settings may only be set in the base configuration", file, key)
+			}
+		}
+
+		// Load the routers, with their defaults.
+		var config Config
+		err = fig.Load(&config,
+			fig.File(filepath.Base(file)),
+			fig.Dirs(filepath.Dir(file)),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		routers = append(routers, config.MidiRouters...)
+	}
+	return routers, nil
+}
+
+// Load the configuration file into the config, reading from stdin or a URL through a temporary file.
+func (a *App) loadConfigFile(configFile string, config *Config) error {
+	if isRemoteConfig(configFile) {
+		file, cleanup, err := a.writeRemoteConfig(configFile)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		configFile = file
+	}
+
+	filePath, fileName := path.Split(configFile)
+	err := fig.Load(config,
+		fig.File(fileName),
+		fig.Dirs(filePath),
+	)
+	if err != nil {
+		return fmt.Errorf("error parsing configuration: %v", err)
+	}
+	return nil
+}
+
+// Reload only the log configuration, keeping the routers and their connections.
+func (a *App) ReloadLogConfig() {
+	configFile, _ := a.ConfigFile()
+	if configFile == "" {
+		log.Println("Unable to find a configuration file, keeping log configuration.")
+		return
+	}
+
+	config := &Config{Log: &LogConfig{}}
+	err := a.loadConfigFile(configFile, config)
+	if err != nil {
+		log.Printf("Error parsing configuration %s, keeping log configuration: %s\n", configFile, err)
+		return
+	}
+	config.Log.Apply()
+	updated := *a.Config()
+	updated.Log = config.Log
+	a.setConfig(&updated)
+	log.Printf("Reloaded log configuration, with level %s.\n", config.Log.Level)
+}
+
+// Load the configuration, applying the log configuration if valid.
+func (a *App) ReadConfig() error {
+	config, err := a.loadConfig()
+	if err == nil {
+		config.Log.Apply()
+	}
+	a.setConfig(config)
+	return err
+}
+
+// Get the configuration in use.
+func (a *App) Config() *Config {
+	a.configMu.RLock()
+	defer a.configMu.RUnlock()
+	return a.config
+}
+
+// Replace the configuration in use.
+func (a *App) setConfig(config *Config) {
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+	a.config = config
+}
+
+// Load and validate the configuration, returning the defaults with the error if it could not be loaded.
+func (a *App) loadConfig() (*Config, error) {
 	// Determine which configuration to use.
-	var configFile string
-	if _, err := os.Stat(app.flags.ConfigPath); err == nil && app.flags.ConfigPath != "" {
-		configFile = app.flags.ConfigPath
-	} else if _, err := os.Stat(localConfig); err == nil {
-		configFile = localConfig
-	} else if _, err := os.Stat(homeDirConfig); err == nil {
-		configFile = homeDirConfig
-	} else if _, err := os.Stat(etcConfig); err == nil {
-		configFile = etcConfig
+	configFile, searched := a.ConfigFile()
+	if configFile == "" {
+		log.Printf("Unable to find a configuration file, searched: %s\n", strings.Join(searched, ", "))
 	} else {
-		log.Println("Unable to find a configuration file.")
+		log.Printf("Loading configuration: %s\n", configFile)
 	}
 
 	// Load the configuration file.
@@ -184,16 +678,26 @@ func (a *App) ReadConfig() {
 		Log: &LogConfig{},
 	}
 
+	// Without a configuration file, use the defaults.
+	if configFile == "" {
+		return config, errConfigNotFound
+	}
+
 	// Load configuration.
-	filePath, fileName := path.Split(configFile)
-	err = fig.Load(config,
-		fig.File(fileName),
-		fig.Dirs(filePath),
-	)
+	err := a.loadConfigFile(configFile, config)
 	if err != nil {
-		app.config = config
-		log.Printf("Error parsing configuration: %s\n", err)
-		return
+		log.Printf("Error parsing configuration %s: %s\n", configFile, err)
+		return config, err
+	}
+
+	// Add the routers of each file in the drop-in directory.
+	if app.flags.ConfigDir != "" {
+		routers, err := loadConfigDir(app.flags.ConfigDir)
+		if err != nil {
+			log.Printf("Error parsing configuration directory %s: %s\n", app.flags.ConfigDir, err)
+			return config, err
+		}
+		config.MidiRouters = append(config.MidiRouters, routers...)
 	}
 
 	// Flag Overrides.
@@ -203,10 +707,96 @@ func (a *App) ReadConfig() {
 	if app.flags.HTTPPort != 0 {
 		config.HTTP.Port = app.flags.HTTPPort
 	}
+	if app.flags.DryRun {
+		for _, router := range config.MidiRouters {
+			router.DryRun = true
+		}
+	}
+
+	// Expand environment variables in secrets and connection settings.
+	config.ExpandEnv()
+
+	// Trim trailing slashes from topics, so sub topics joined to them are well formed.
+	for _, router := range config.MidiRouters {
+		router.MQTT.Topic = strings.TrimRight(router.MQTT.Topic, "/")
+	}
 
-	// Apply log configs.
+	// Migrate deprecated options.
+	for _, router := range config.MidiRouters {
+		for i := range router.NoteTriggers {
+			trig := &router.NoteTriggers[i]
+			if trig.DeprecatedDelayAfter != 0 {
+				log.Warnf("Router %s: the note trigger option deplay_after is deprecated, use delay_after instead.", router.Name)
+				if trig.DelayAfter == 0 {
+					trig.DelayAfter = trig.DeprecatedDelayAfter
+				}
+			}
+		}
+	}
+
+	// Check for errors, such as invalid regular expressions, before connecting.
+	err = config.Validate()
+	if err != nil {
+		log.Printf("Configuration invalid:\n%s\n", err)
+		return config, err
+	}
+	return config, nil
+}
+
+// Reload the configuration, reconnecting only routers which changed.
+func (a *App) ReloadConfig() {
+	log.Println("Reloading configuration.")
+	oldConfig := a.Config()
+	config, err := a.loadConfig()
+	if err != nil {
+		log.Println("Keeping previous configuration.")
+		return
+	}
+
+	// Keep existing connections of routers with unchanged configurations.
+	kept := make(map[*MidiRouter]bool)
+	var connect []*MidiRouter
+	for i, router := range config.MidiRouters {
+		var match *MidiRouter
+		for _, old := range oldConfig.MidiRouters {
+			if !kept[old] && old.ConfigEqual(router) {
+				match = old
+				break
+			}
+		}
+		if match != nil {
+			kept[match] = true
+			config.MidiRouters[i] = match
+		} else {
+			connect = append(connect, router)
+		}
+	}
+
+	// HTTP server settings require a restart, so keep them.
+	config.HTTP = oldConfig.HTTP
+
+	// Use the new configuration once complete, so requests never see it partially updated.
 	config.Log.Apply()
+	a.setConfig(config)
+
+	// Disconnect routers which were removed or changed, draining in-flight requests.
+	for _, old := range oldConfig.MidiRouters {
+		if !kept[old] {
+			log.Printf("Disconnecting router: %s\n", old.Name)
+			old.Disconnect()
+		}
+	}
+
+	// Connect routers which were added or changed.
+	for _, router := range connect {
+		router.LogSummary()
+		if router.Disabled {
+			continue
+		}
+		log.Printf("Connecting router: %s\n", router.Name)
+		router.Connect()
+	}
 
-	// Set global config structure.
-	app.config = config
+	// Update HTTP routes to the new routers.
+	a.http.ReloadRoutes()
 }
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Use a configuration file with the YAML for the test, restoring the previous app after.
+func useConfigFile(t *testing.T, yaml string) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(yaml), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := app
+	app = &App{flags: &Flags{ConfigPath: path}}
+	t.Cleanup(func() {
+		app = old
+	})
+}
+
+func TestReadConfigInvalidKeepsLogConfig(t *testing.T) {
+	useConfigFile(t, `log:
+  level: debug
+  outputs: [console]
+midi_routers:
+  - name: test
+    channel_display_base: 2
+`)
+	level := log.GetLevel()
+	t.Cleanup(func() {
+		log.SetLevel(level)
+	})
+
+	// The log level of an invalid configuration is not applied.
+	log.SetLevel(log.InfoLevel)
+	if err := app.ReadConfig(); err == nil {
+		t.Fatal("invalid configuration read without error")
+	}
+	if got := log.GetLevel(); got != log.InfoLevel {
+		t.Errorf("log level %s, want %s", got, log.InfoLevel)
+	}
+}
+
+func TestValidateNoteTriggers(t *testing.T) {
+	tests := []struct {
+		name    string
+		trigger NoteTrigger
+		err     string
+	}{
+		{
+			name:    "note range",
+			trigger: NoteTrigger{NoteMin: 36, NoteMax: 43},
+		},
+		{
+			name:    "note range without max",
+			trigger: NoteTrigger{NoteMin: 36},
+		},
+		{
+			name:    "note min above max",
+			trigger: NoteTrigger{NoteMin: 43, NoteMax: 36},
+			err:     "note min can not be above note max",
+		},
+		{
+			name:    "note above range",
+			trigger: NoteTrigger{Note: 128},
+			err:     "note must be 0 to 127",
+		},
+		{
+			name:    "note min above range",
+			trigger: NoteTrigger{NoteMin: 200},
+			err:     "note min must be 0 to 127",
+		},
+		{
+			name:    "note max above range",
+			trigger: NoteTrigger{NoteMin: 10, NoteMax: 255},
+			err:     "note max must be 0 to 127",
+		},
+		{
+			name:    "velocity min above max",
+			trigger: NoteTrigger{VelocityMin: 100, VelocityMax: 10},
+			err:     "velocity min can not be above velocity max",
+		},
+		{
+			name:    "message type",
+			trigger: NoteTrigger{MessageType: ControlChangeMessage},
+		},
+		{
+			name:    "unsupported message type",
+			trigger: NoteTrigger{MessageType: "control"},
+			err:     "note trigger 0 unsupported message type: control",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{MidiRouters: []*MidiRouter{{Name: "test", OSC: OSCConfig{Prefix: "/midi"}, NoteTriggers: []NoteTrigger{tt.trigger}}}}
+			err := config.Validate()
+			if tt.err == "" && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateRequestTriggers(t *testing.T) {
+	tests := []struct {
+		name    string
+		trigger RequestTrigger
+		err     string
+	}{
+		{
+			name:    "in range",
+			trigger: RequestTrigger{Channel: 15, Note: 127, Velocity: 127},
+		},
+		{
+			name:    "channel above range",
+			trigger: RequestTrigger{Channel: 16},
+			err:     "request trigger 0 channel must be a number from 0 to 15",
+		},
+		{
+			name:    "note above range",
+			trigger: RequestTrigger{Note: 200},
+			err:     "request trigger 0 note must be a number from 0 to 127",
+		},
+		{
+			name:    "velocity above range",
+			trigger: RequestTrigger{Velocity: 255},
+			err:     "request trigger 0 velocity must be a number from 0 to 127",
+		},
+		{
+			name:    "unsupported message type",
+			trigger: RequestTrigger{MessageType: "cc"},
+			err:     "request trigger 0 unsupported message type: cc",
+		},
+		{
+			name:    "sequence note above range",
+			trigger: RequestTrigger{Sequence: []MessageSpec{{Note: 60}, {Note: 128}}},
+			err:     "request trigger 0 sequence 1 note must be a number from 0 to 127",
+		},
+		{
+			name:    "sequence velocity above range",
+			trigger: RequestTrigger{Sequence: []MessageSpec{{Velocity: 128}}},
+			err:     "request trigger 0 sequence 0 velocity must be a number from 0 to 127",
+		},
+		{
+			name:    "sequence channel above range",
+			trigger: RequestTrigger{Sequence: []MessageSpec{{Channel: 16}}},
+			err:     "request trigger 0 sequence 0 channel must be a number from 0 to 15",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{MidiRouters: []*MidiRouter{{Name: "test", OSC: OSCConfig{Prefix: "/midi"}, RequestTriggers: []RequestTrigger{tt.trigger}}}}
+			err := config.Validate()
+			if tt.err == "" && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	r := &MidiRouter{
+		NoteTriggers:    []NoteTrigger{{Headers: http.Header{"authorization": {"Bearer secret"}, "X-Device": {"keys"}}}},
+		FirehoseWebhook: FirehoseWebhook{Headers: http.Header{"X-Api-Key": {"secret"}}},
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("credential header not redacted: %s", data)
+	}
+	if !strings.Contains(string(data), "keys") {
+		t.Errorf("other header redacted: %s", data)
+	}
+
+	// Changes to the redacted headers are still seen as configuration changes.
+	other := &MidiRouter{
+		NoteTriggers:    []NoteTrigger{{Headers: http.Header{"authorization": {"Bearer other"}, "X-Device": {"keys"}}}},
+		FirehoseWebhook: r.FirehoseWebhook,
+	}
+	if r.ConfigEqual(other) {
+		t.Error("routers with different credential headers are equal")
+	}
+}
+
+func TestDelayAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{name: "delay after", key: "delay_after"},
+		{name: "deprecated misspelling", key: "deplay_after"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfigFile(t, `midi_routers:
+  - name: test
+    note_triggers:
+      - note: 60
+        `+tt.key+`: 2s
+`)
+			config, err := app.loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := config.MidiRouters[0].NoteTriggers[0].DelayAfter; got != 2*time.Second {
+				t.Errorf("delay after %s, want 2s", got)
+			}
+		})
+	}
+}
+
+func TestTriggerHeaders(t *testing.T) {
+	useConfigFile(t, `midi_routers:
+  - name: test
+    note_triggers:
+      - note: 60
+        headers:
+          x-device: keys
+          Accept: [application/json, text/plain]
+`)
+	config, err := app.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trig := config.MidiRouters[0].NoteTriggers[0]
+
+	tests := []struct {
+		name string
+		body string
+		want http.Header
+	}{
+		{
+			name: "without body",
+			want: http.Header{
+				"X-Device":   {"keys"},
+				"Accept":     {"application/json", "text/plain"},
+				"User-Agent": {userAgent},
+			},
+		},
+		{
+			name: "json body",
+			body: ` {"note":60}`,
+			want: http.Header{
+				"X-Device":     {"keys"},
+				"Accept":       {"application/json", "text/plain"},
+				"User-Agent":   {userAgent},
+				"Content-Type": {"application/json"},
+			},
+		},
+		{
+			name: "text body",
+			body: "note 60",
+			want: http.Header{
+				"X-Device":     {"keys"},
+				"Accept":       {"application/json", "text/plain"},
+				"User-Agent":   {userAgent},
+				"Content-Type": {"text/plain"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := trig.RequestHeader(tt.body)
+			if !maps.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("headers %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A trigger without headers still gets the defaults.
+	var empty NoteTrigger
+	if got := empty.RequestHeader(""); got.Get("User-Agent") != userAgent {
+		t.Errorf("user agent %q, want %q", got.Get("User-Agent"), userAgent)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("TEST_MQTT_PASSWORD", "secret")
+	t.Setenv("TEST_API_KEY", "key")
+	useConfigFile(t, `http:
+  api_key: ${TEST_API_KEY}
+midi_routers:
+  - name: test
+    mqtt:
+      host: broker.local
+      topic: midi
+      password: ${TEST_MQTT_PASSWORD}
+      user: $literal
+    note_triggers:
+      - note: 60
+        bearer_token: token-${TEST_UNSET_VAR}
+`)
+	config, err := app.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := config.MidiRouters[0]
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{name: "api key", got: config.HTTP.APIKey, want: "key"},
+		{name: "mqtt password", got: router.MQTT.Password, want: "secret"},
+		{name: "literal", got: router.MQTT.Host, want: "broker.local"},
+		{name: "dollar without braces", got: router.MQTT.User, want: "$literal"},
+		{name: "unset variable", got: router.NoteTriggers[0].BearerToken, want: "token-"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestMqttOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		mqtt      string
+		keepAlive int64
+		timeout   time.Duration
+		reconnect time.Duration
+	}{
+		{
+			name:      "defaults",
+			keepAlive: 30,
+			timeout:   30 * time.Second,
+			reconnect: time.Minute,
+		},
+		{
+			name: "configured",
+			mqtt: `
+      keep_alive: 10s
+      connect_timeout: 5s
+      max_reconnect_interval: 20s`,
+			keepAlive: 10,
+			timeout:   5 * time.Second,
+			reconnect: 20 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfigFile(t, `midi_routers:
+  - name: test
+    mqtt:
+      host: broker.local
+      topic: midi`+tt.mqtt+`
+`)
+			config, err := app.loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts, err := config.MidiRouters[0].mqttOptions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.KeepAlive != tt.keepAlive {
+				t.Errorf("keep alive %ds, want %ds", opts.KeepAlive, tt.keepAlive)
+			}
+			if opts.ConnectTimeout != tt.timeout {
+				t.Errorf("connect timeout %s, want %s", opts.ConnectTimeout, tt.timeout)
+			}
+			if !opts.AutoReconnect {
+				t.Error("auto reconnect disabled")
+			}
+			if opts.MaxReconnectInterval != tt.reconnect {
+				t.Errorf("max reconnect interval %s, want %s", opts.MaxReconnectInterval, tt.reconnect)
+			}
+		})
+	}
+}
+
+func TestInvalidDeviceRegexp(t *testing.T) {
+	r := &MidiRouter{Name: "test", Device: "[", OSC: OSCConfig{Prefix: "/midi"}}
+	config := &Config{MidiRouters: []*MidiRouter{r}}
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "invalid device regexp '['") {
+		t.Errorf("error %v, want invalid device regexp", err)
+	}
+
+	// Connecting skips the devices, rather than matching with a nil expression.
+	useFakeDevices(t).Add(&fakeInPort{name: "["}, &fakeOutPort{name: "["})
+	r.RequestTriggers = []RequestTrigger{{URI: "/note"}}
+	r.Connect()
+	r.Disconnect()
+}
+
+func TestMqttTopic(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+		want  string
+		err   string
+	}{
+		{name: "topic", topic: "midi/example", want: "midi/example"},
+		{name: "trailing slash", topic: "midi/example/", want: "midi/example"},
+		{name: "trailing slashes", topic: "midi/example//", want: "midi/example"},
+		{name: "empty", topic: "", err: "mqtt topic is required when a host is set"},
+		{name: "only slash", topic: "/", err: "mqtt topic is required when a host is set"},
+		{name: "single level wildcard", topic: "midi/+", err: "can not contain the wildcards"},
+		{name: "multi level wildcard", topic: "midi/#", err: "can not contain the wildcards"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfigFile(t, `midi_routers:
+  - name: test
+    mqtt:
+      host: broker.local
+      topic: "`+tt.topic+`"
+`)
+			config, err := app.loadConfig()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := config.MidiRouters[0].MQTT.Topic; got != tt.want {
+				t.Errorf("topic %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -9,9 +9,14 @@ import (
 // Flags supplied to cli.
 type Flags struct {
 	ConfigPath      string
+	ConfigDir       string
 	HTTPBind        string
 	HTTPPort        uint
 	ListMidiDevices bool
+	Validate        bool
+	DryRun          bool
+	Monitor         string
+	PrintConfigPath bool
 }
 
 // Parse the supplied flags.
@@ -31,6 +36,9 @@ func (a *App) ParseFlags() {
 	flag.StringVar(&app.flags.ConfigPath, "config", "", usage)
 	flag.StringVar(&app.flags.ConfigPath, "c", "", usage+" (shorthand)")
 
+	// Drop-in directory of router configurations.
+	flag.StringVar(&app.flags.ConfigDir, "config-dir", "", "Also load the routers of each YAML file in `DIR`")
+
 	// Config overrides for http configurations.
 	flag.StringVar(&app.flags.HTTPBind, "http-bind", "", "Bind address for http server")
 	flag.UintVar(&app.flags.HTTPPort, "http-port", 0, "Bind port for http server")
@@ -40,6 +48,18 @@ func (a *App) ParseFlags() {
 	flag.BoolVar(&app.flags.ListMidiDevices, "list", false, usage)
 	flag.BoolVar(&app.flags.ListMidiDevices, "l", false, usage+" (shorthand)")
 
+	// Print the MIDI messages received from devices.
+	flag.StringVar(&app.flags.Monitor, "monitor", "", "Print the MIDI messages received from input devices matching the regular expression `DEVICE`, without a configuration")
+
+	// Print the configuration file used and exit.
+	flag.BoolVar(&app.flags.PrintConfigPath, "print-config-path", false, "Print the path of the configuration file which would be loaded and exit")
+
+	// Validate the configuration and exit.
+	flag.BoolVar(&app.flags.Validate, "validate", false, "Validate the configuration and exit")
+
+	// Log what would be sent instead of sending.
+	flag.BoolVar(&app.flags.DryRun, "dry-run", false, "Log the requests and MIDI messages triggers would send, without sending them")
+
 	// Parse the flags.
 	flag.Parse()
 
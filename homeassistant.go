@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Prefix of Home Assistant MQTT discovery topics.
+const homeAssistantDiscoveryPrefix = "homeassistant"
+
+// Device the Home Assistant entities belong to.
+type HomeAssistantDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// Discovery config of a Home Assistant device trigger.
+type HomeAssistantDeviceTrigger struct {
+	AutomationType string              `json:"automation_type"`
+	Topic          string              `json:"topic"`
+	Type           string              `json:"type"`
+	Subtype        string              `json:"subtype"`
+	Payload        string              `json:"payload,omitempty"`
+	Device         HomeAssistantDevice `json:"device"`
+}
+
+// Discovery config of a Home Assistant button.
+type HomeAssistantButton struct {
+	Name              string              `json:"name"`
+	UniqueID          string              `json:"unique_id"`
+	CommandTopic      string              `json:"command_topic"`
+	PayloadPress      string              `json:"payload_press"`
+	AvailabilityTopic string              `json:"availability_topic"`
+	Device            HomeAssistantDevice `json:"device"`
+}
+
+// Only letters, numbers, underscores, and hyphens are allowed in discovery node IDs.
+var homeAssistantIDRx = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// Get the node ID used in discovery topics for this router.
+func (r *MidiRouter) homeAssistantNodeID() string {
+	name := r.Name
+	if name == "" {
+		name = r.MQTT.ClientId
+	}
+	return strings.Trim(homeAssistantIDRx.ReplaceAllString(strings.ToLower(name), "_"), "_")
+}
+
+// Build the discovery configs of each trigger, keyed by discovery topic.
+func (r *MidiRouter) homeAssistantDiscovery() map[string]interface{} {
+	nodeID := r.homeAssistantNodeID()
+	device := HomeAssistantDevice{
+		Identifiers:  []string{serviceName + "_" + nodeID},
+		Name:         r.Name,
+		Manufacturer: "MIDI Request Trigger",
+		Model:        r.Device,
+		SWVersion:    serviceVersion,
+	}
+	configs := make(map[string]interface{})
+
+	// Note triggers which publish to MQTT become device triggers.
+	for i, trig := range r.NoteTriggers {
+		// Templated topics can not be subscribed to by Home Assistant.
+		if trig.MqttTopic == "" || strings.Contains(trig.MqttTopic, "{{") {
+			continue
+		}
+		config := HomeAssistantDeviceTrigger{
+			AutomationType: "trigger",
+			Topic:          trig.MqttTopic,
+			Type:           "button_short_press",
+			Subtype:        fmt.Sprintf("note_trigger_%d", i),
+			Device:         device,
+		}
+		// If the payload is fixed, only fire on that payload.
+		if trig.MqttPayload != nil {
+			data, err := json.Marshal(trig.MqttPayload)
+			if err != nil {
+				r.Log(ErrorLog, "Json Encode: %s", err)
+				continue
+			}
+			config.Payload = string(data)
+		}
+		topic := fmt.Sprintf("%s/device_automation/%s/note_trigger_%d/config", homeAssistantDiscoveryPrefix, nodeID, i)
+		configs[topic] = config
+	}
+
+	// Request triggers become buttons which send the trigger message.
+	for i, trig := range r.RequestTriggers {
+		data, err := json.Marshal(trig.Payload())
+		if err != nil {
+			r.Log(ErrorLog, "Json Encode: %s", err)
+			continue
+		}
+		commandTopic := r.MQTT.Topic + "/send"
+		if trig.MqttTopic != "" {
+			commandTopic = trig.MqttTopic
+		} else if trig.MqttSubTopic != "" {
+			commandTopic = r.MQTT.Topic + "/" + trig.MqttSubTopic
+		}
+		objectID := fmt.Sprintf("request_trigger_%d", i)
+		config := HomeAssistantButton{
+			Name:              fmt.Sprintf("%s %s", r.Name, trig.Payload()),
+			UniqueID:          nodeID + "_" + objectID,
+			CommandTopic:      commandTopic,
+			PayloadPress:      string(data),
+			AvailabilityTopic: r.MQTT.GetAvailabilityTopic(),
+			Device:            device,
+		}
+		topic := fmt.Sprintf("%s/button/%s/%s/config", homeAssistantDiscoveryPrefix, nodeID, objectID)
+		configs[topic] = config
+	}
+	return configs
+}
+
+// Publish Home Assistant discovery configs for each trigger.
+func (r *MidiRouter) SendHomeAssistantDiscovery() {
+	for topic, config := range r.homeAssistantDiscovery() {
+		data, err := json.Marshal(config)
+		if err != nil {
+			r.Log(ErrorLog, "Json Encode: %s", err)
+			continue
+		}
+		r.mqttPublish(topic, r.MQTT.QoS, true, data)
+		r.LogWithFields(SendLog, log.Fields{"topic": topic}, "-> [MQTT] %s: %s", topic, string(data))
+	}
+}
+
+// Remove Home Assistant discovery configs by publishing empty retained payloads.
+func (r *MidiRouter) RemoveHomeAssistantDiscovery() {
+	for topic := range r.homeAssistantDiscovery() {
+		t := r.mqttPublish(topic, r.MQTT.QoS, true, []byte{})
+		t.WaitTimeout(time.Second)
+		r.LogWithFields(SendLog, log.Fields{"topic": topic}, "-> [MQTT] %s: (removed)", topic)
+	}
+}
@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -17,32 +24,232 @@ import (
 type HTTPServer struct {
 	server *http.Server
 	mux    *mux.Router
+	muxMu  sync.RWMutex
 	config *HTTPConfig
+	// Networks allowed to make requests, or all if empty.
+	allowedNets []*net.IPNet
+	// Networks of the proxies trusted to set the proxy header.
+	trustedProxyNets []*net.IPNet
+	// Limit of the rate of trigger requests, or nil if unlimited.
+	limiter *rateLimiter
+	// Closed once the server has shut down.
+	shutdown chan struct{}
 }
 
 // This functions starts the HTTP server.
 func NewHTTPServer() *HTTPServer {
 	s := new(HTTPServer)
+	s.shutdown = make(chan struct{})
 	// Update config reference.
-	s.config = &app.config.HTTP
+	s.config = &app.Config().HTTP
 	s.server = &http.Server{}
-	s.server.Addr = fmt.Sprintf("%s:%d", s.config.BindAddr, s.config.Port)
+	s.server.Addr = net.JoinHostPort(s.config.BindAddr, strconv.Itoa(int(s.config.Port)))
+
+	// Limit the rate of trigger requests if configured.
+	if s.config.RateLimit > 0 {
+		s.limiter = newRateLimiter(s.config.RateLimit, s.config.RateBurst)
+	}
 
 	// Setup router.
+	s.mux = s.NewRouter()
+
+	// Invalid networks are caught by config validation, so are ignored here.
+	s.allowedNets, _ = parseCIDRs(s.config.AllowedCIDRs)
+	s.trustedProxyNets, _ = parseCIDRs(s.config.TrustedProxyCIDRs)
+	s.server.Handler = s.allowed(s)
+	// If the debug log is enabled, we'll add a middleware handler to log then pass the request to mux router.
+	if app.Config().HTTP.Debug {
+		s.server.Handler = handlers.CombinedLoggingHandler(os.Stdout, s.server.Handler)
+	}
+
+	return s
+}
+
+// Make a router with the default routes and the request triggers of each MIDI router.
+func (s *HTTPServer) NewRouter() *mux.Router {
 	r := mux.NewRouter()
-	s.mux = r
 	// Default to notice of service being online.
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, "MIDI Request Trigger is available\n")
 	})
+	// Report connection status of each router.
+	r.HandleFunc("/healthz", s.HealthHandler)
+	// Expose Prometheus metrics.
+	r.Handle("/metrics", promhttp.Handler())
+	// List the MIDI devices available.
+	r.HandleFunc("/api/devices", s.authenticated(s.DevicesHandler)).Methods(http.MethodGet)
+	// Show the configuration loaded.
+	r.HandleFunc("/api/config", s.authenticated(s.ConfigHandler)).Methods(http.MethodGet)
+	// Send a MIDI message to a router.
+	r.HandleFunc("/api/send/{router}", s.authenticated(s.SendHandler)).Methods(http.MethodPost)
+	// Silence all notes of a router.
+	r.HandleFunc("/api/panic/{router}", s.authenticated(s.PanicHandler)).Methods(http.MethodPost)
+	// Stream the MIDI messages received by a router.
+	r.HandleFunc("/ws/{router}", s.authenticated(s.WebSocketHandler))
+	r.HandleFunc("/events/{router}", s.authenticated(s.EventsHandler)).Methods(http.MethodGet)
+	// Web UI for testing triggers, which has no secrets, so asks for the API key to make its requests with.
+	ui := s.UIHandler()
+	r.Handle("/ui", ui)
+	r.PathPrefix("/ui/").Handler(ui)
 
-	s.server.Handler = r
-	// If the debug log is enabled, we'll add a middleware handler to log then pass the request to mux router.
-	if app.config.HTTP.Debug {
-		s.server.Handler = handlers.CombinedLoggingHandler(os.Stdout, r)
+	// Group routers by the URIs of their request triggers, so routers sharing a URI are all triggered.
+	var paths []string
+	routers := make(map[string][]*MidiRouter)
+	for _, router := range app.Config().MidiRouters {
+		if router.Disabled {
+			continue
+		}
+		for _, trig := range router.RequestTriggers {
+			for _, path := range []string{trig.URI, trig.URIPattern} {
+				if path == "" || slices.Contains(routers[path], router) {
+					continue
+				}
+				if _, ok := routers[path]; !ok {
+					paths = append(paths, path)
+				}
+				routers[path] = append(routers[path], router)
+			}
+		}
 	}
 
-	return s
+	// Setup HTTP handlers for each URI.
+	for _, path := range paths {
+		r.HandleFunc(path, s.rateLimited(RequestTriggersHandler(routers[path])))
+	}
+	return r
+}
+
+// Connection status of a router, nil values are connections not expected.
+type RouterHealth struct {
+	Disabled bool            `json:"disabled,omitempty"`
+	State    ConnectionState `json:"state"`
+	MidiIn   *bool           `json:"midi_in,omitempty"`
+	MidiOut  *bool           `json:"midi_out,omitempty"`
+	MQTT     *bool           `json:"mqtt,omitempty"`
+}
+
+// Health status of the service.
+type HealthStatus struct {
+	Healthy bool                     `json:"healthy"`
+	Routers map[string]*RouterHealth `json:"routers"`
+}
+
+// Reports the connection status of each router, returning 503 if any expected connection is down.
+func (s *HTTPServer) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	status := HealthStatus{
+		Healthy: true,
+		Routers: make(map[string]*RouterHealth),
+	}
+
+	// Check the expected connections of each router.
+	for _, router := range app.Config().MidiRouters {
+		if router.Disabled {
+			status.Routers[router.Name] = &RouterHealth{Disabled: true, State: Disconnected}
+			continue
+		}
+		health := &RouterHealth{State: router.ConnectionState()}
+		if !router.DisableListener {
+			connected := router.listening()
+			health.MidiIn = &connected
+			status.Healthy = status.Healthy && connected
+		}
+		if router.NeedsOutput() {
+			connected := router.midiOut() != nil
+			health.MidiOut = &connected
+			status.Healthy = status.Healthy && connected
+		}
+		if router.MQTT.Host != "" && router.MQTT.Port != 0 {
+			connected := router.mqttConnected()
+			health.MQTT = &connected
+			status.Healthy = status.Healthy && connected
+		}
+		status.Routers[router.Name] = health
+	}
+
+	// Send the status.
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// Parse networks in CIDR notation, with addresses without a prefix length matching only that address.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%s'", cidr)
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Check if the address is in any of the networks.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the address of the client, from the proxy header if the request is from a trusted proxy.
+func (s *HTTPServer) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	if s.config.TrustedProxyHeader != "" && containsIP(s.trustedProxyNets, remote) {
+		// Use the last address, which was added by the trusted proxy.
+		if header := r.Header.Get(s.config.TrustedProxyHeader); header != "" {
+			addrs := strings.Split(header, ",")
+			return net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1]))
+		}
+	}
+	return remote
+}
+
+// Only allow requests from the allowed networks, if any are configured.
+func (s *HTTPServer) allowed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.allowedNets) != 0 && !containsIP(s.allowedNets, s.clientIP(r)) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Replace the router with one built from the current configuration.
+func (s *HTTPServer) ReloadRoutes() {
+	r := s.NewRouter()
+	s.muxMu.Lock()
+	s.mux = r
+	s.muxMu.Unlock()
+}
+
+// Pass requests to the current router.
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.muxMu.RLock()
+	m := s.mux
+	s.muxMu.RUnlock()
+	m.ServeHTTP(w, r)
 }
 
 // Start the HTTP server.
@@ -54,21 +261,50 @@ func (s *HTTPServer) Start(ctx context.Context) {
 	<-isListening
 }
 
+// Wait for the server to shut down once its context is done.
+func (s *HTTPServer) Wait() {
+	<-s.shutdown
+}
+
+// Listen on the network configured, defaulting to tcp.
+func (s *HTTPServer) listen() (net.Listener, error) {
+	network := s.config.Network
+	if network == "" {
+		network = "tcp"
+	}
+	return net.Listen(network, s.server.Addr)
+}
+
 // Starts the HTTP server with a listening channel.
 func (s *HTTPServer) StartWithIsListening(ctx context.Context, isListening chan bool) {
 	// Watch the background context for when we need to shutdown.
 	go func() {
 		<-ctx.Done()
-		err := s.server.Shutdown(context.Background())
-		if err != nil {
-			// Error from closing listeners, or context timeout:
+		defer close(s.shutdown)
+
+		// Wait for requests to complete, up to the shutdown timeout.
+		shutdownCtx := context.Background()
+		if s.config.ShutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			shutdownCtx, cancel = context.WithTimeout(shutdownCtx, s.config.ShutdownTimeout)
+			defer cancel()
+		}
+		err := s.server.Shutdown(shutdownCtx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			// Requests are still in progress, so force the connections closed.
+			log.Printf("HTTP server did not shut down within %s, closing connections", s.config.ShutdownTimeout)
+			s.server.Close()
+		} else if err != nil {
+			// Error from closing listeners.
 			log.Println("Error shutting down http server:", err)
+		} else {
+			log.Println("HTTP server shut down gracefully")
 		}
 	}()
 
 	// Start the server.
 	log.Println("Starting http server:", s.server.Addr)
-	l, err := net.Listen("tcp", s.server.Addr)
+	l, err := s.listen()
 	if err != nil {
 		log.Fatal("Listen: ", err)
 	}
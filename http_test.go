@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/gomidi/midi/v2"
+)
+
+// Use the configuration for the test, restoring the previous app after.
+func useConfig(t *testing.T, config *Config) {
+	old := app
+	app = &App{config: config}
+	t.Cleanup(func() {
+		app = old
+	})
+}
+
+// Get the status of the health endpoint.
+func healthStatus() int {
+	w := httptest.NewRecorder()
+	new(HTTPServer).HealthHandler(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	return w.Code
+}
+
+func TestHealthHandler(t *testing.T) {
+	devices := useFakeDevices(t)
+	in := &fakeInPort{name: "keys in"}
+	out := &fakeOutPort{name: "keys out"}
+	devices.Add(in, out)
+	r := &MidiRouter{
+		Device:              "keys",
+		ReconnectInterval:   time.Millisecond,
+		DeviceCheckInterval: time.Millisecond,
+		RequestTriggers:     []RequestTrigger{{URI: "/note"}},
+	}
+	useConfig(t, &Config{MidiRouters: []*MidiRouter{r}})
+	r.Connect()
+	defer r.Disconnect()
+	waitFor(t, "connection", func() bool { return healthStatus() == http.StatusOK })
+
+	// Removing the devices is reported while the router reconnects.
+	devices.RemoveAll()
+	waitFor(t, "device removal", func() bool { return healthStatus() == http.StatusServiceUnavailable })
+	devices.Add(in, out)
+	waitFor(t, "reconnection", func() bool { return healthStatus() == http.StatusOK })
+}
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote string
+		header string
+		status int
+	}{
+		{name: "allowed", remote: "192.168.1.5:5000", status: http.StatusOK},
+		{name: "denied", remote: "203.0.113.5:5000", status: http.StatusForbidden},
+		{name: "allowed through proxy", remote: "10.0.0.2:5000", header: "203.0.113.5, 192.168.1.5", status: http.StatusOK},
+		{name: "denied through proxy", remote: "10.0.0.2:5000", header: "192.168.1.5, 203.0.113.5", status: http.StatusForbidden},
+		{name: "proxy without header", remote: "10.0.0.2:5000", status: http.StatusForbidden},
+		{name: "header from untrusted address", remote: "203.0.113.5:5000", header: "192.168.1.5", status: http.StatusForbidden},
+	}
+	config := &HTTPConfig{TrustedProxyHeader: "X-Forwarded-For"}
+	allowedNets, _ := parseCIDRs([]string{"192.168.1.0/24"})
+	trustedProxyNets, _ := parseCIDRs([]string{"10.0.0.2"})
+	s := &HTTPServer{config: config, allowedNets: allowedNets, trustedProxyNets: trustedProxyNets}
+	handler := s.allowed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/note", nil)
+			req.RemoteAddr = tt.remote
+			if tt.header != "" {
+				req.Header.Set("X-Forwarded-For", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestSharedURI(t *testing.T) {
+	piano := &fakeOutPort{name: "piano"}
+	lights := &fakeOutPort{name: "lights"}
+	useConfig(t, &Config{MidiRouters: []*MidiRouter{
+		{Name: "piano", MidiOut: piano, RequestTriggers: []RequestTrigger{{URI: "/trigger", Note: 60, Velocity: 100, SuccessStatus: http.StatusNoContent}}},
+		{Name: "lights", MidiOut: lights, RequestTriggers: []RequestTrigger{{URI: "/trigger", Note: 10, Velocity: 127, SuccessStatus: http.StatusNoContent}}},
+	}})
+
+	// Both routers sharing the URI are triggered by one request.
+	w := httptest.NewRecorder()
+	new(HTTPServer).NewRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/trigger", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	assertSent(t, piano, midi.NoteOn(0, 60, 100))
+	assertSent(t, lights, midi.NoteOn(0, 10, 127))
+}
+
+func TestListenNetwork(t *testing.T) {
+	tests := []struct {
+		network string
+		ipv6    bool
+	}{
+		{network: "tcp4"},
+		{network: "tcp6", ipv6: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			s := &HTTPServer{config: &HTTPConfig{Network: tt.network}, server: &http.Server{Addr: ":0"}}
+			l, err := s.listen()
+			if err != nil {
+				t.Skipf("unable to listen on %s: %s", tt.network, err)
+			}
+			defer l.Close()
+			ip := l.Addr().(*net.TCPAddr).IP
+			if got := ip.To4() == nil; got != tt.ipv6 {
+				t.Errorf("listening on %s, want IPv6 %t", ip, tt.ipv6)
+			}
+		})
+	}
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	// Find a free address to serve on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	started := make(chan struct{})
+	var completed atomic.Bool
+	s := &HTTPServer{
+		config: &HTTPConfig{ShutdownTimeout: 5 * time.Second},
+		server: &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			completed.Store(true)
+		})},
+		shutdown: make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	go http.Get("http://" + addr + "/")
+	<-started
+
+	// Waiting returns once the request in progress completes.
+	cancel()
+	s.Wait()
+	if !completed.Load() {
+		t.Error("shut down before the request in progress completed")
+	}
+}
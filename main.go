@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
 
 	log "github.com/sirupsen/logrus"
@@ -20,9 +24,13 @@ const (
 
 // App is the global application structure for communicating between servers and storing information.
 type App struct {
-	flags  *Flags
-	config *Config
-	http   *HTTPServer
+	flags *Flags
+	// Configuration in use, replaced on reloads while requests read it.
+	config   *Config
+	configMu sync.RWMutex
+	http     *HTTPServer
+	// Configuration read from stdin, kept for reloads as stdin can only be read once.
+	stdinConfig []byte
 }
 
 var app *App
@@ -30,16 +38,53 @@ var app *App
 func main() {
 	app = new(App)
 	app.ParseFlags()
-	app.ReadConfig()
+
+	// If requested, print the MIDI messages received until interrupted.
+	if app.flags.Monitor != "" {
+		err := monitor(app.flags.Monitor)
+		midi.CloseDriver()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "monitor: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// If requested, print the configuration file used and exit.
+	if app.flags.PrintConfigPath {
+		configFile, searched := app.ConfigFile()
+		if configFile == "" {
+			fmt.Fprintf(os.Stderr, "no configuration file found, searched: %s\n", strings.Join(searched, ", "))
+			os.Exit(1)
+		}
+		fmt.Println(configFile)
+		return
+	}
+	err := app.ReadConfig()
+
+	// If requested, validate the configuration and exit.
+	if app.flags.Validate {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration invalid:\n%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration OK")
+		return
+	}
+
+	// Without a configuration the defaults are used, but an invalid configuration should not be mistaken for none.
+	if err != nil && !errors.Is(err, errConfigNotFound) {
+		log.Fatalf("Not starting with an invalid configuration: %s", err)
+	}
 	app.http = NewHTTPServer()
 
 	// Make sure midi drivers are closed when the app closes.
 	defer midi.CloseDriver()
 
 	// If no routers defined, or request to list devices.
-	if app.flags.ListMidiDevices || len(app.config.MidiRouters) == 0 {
+	if app.flags.ListMidiDevices || len(app.Config().MidiRouters) == 0 {
 		// If no routers are defined, print notice about configuring one.
-		if len(app.config.MidiRouters) == 0 {
+		if len(app.Config().MidiRouters) == 0 {
 			log.Println("No routers configured, please configure one.")
 		}
 		// Print available devices.
@@ -51,11 +96,11 @@ func main() {
 		return
 	}
 
-	// Connect to each router and and setup HTTP handlers.
-	for _, router := range app.config.MidiRouters {
-		router.Connect()
-		for _, trig := range router.RequestTriggers {
-			app.http.mux.HandleFunc(trig.URI, router.Handler)
+	// Connect to each router.
+	for _, router := range app.Config().MidiRouters {
+		router.LogSummary()
+		if !router.Disabled {
+			router.Connect()
 		}
 	}
 
@@ -66,14 +111,31 @@ func main() {
 
 	// Monitor common signals.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	// Wait for a signal.
-	<-c
-	// Stop HTTP server.
+	signal.Notify(c, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}, reloadLogSignals...)...)
+	// Wait for a signal to stop, reloading the configuration on hangup.
+	for sig := range c {
+		if sig == syscall.SIGHUP {
+			app.ReloadConfig()
+			continue
+		}
+		if slices.Contains(reloadLogSignals, sig) {
+			app.ReloadLogConfig()
+			continue
+		}
+		break
+	}
+	// Stop HTTP server, waiting for requests in progress before disconnecting the routers they use.
 	ctxCancel()
+	app.http.Wait()
 
-	// Disconnect all MIDI listeners.
-	for _, router := range app.config.MidiRouters {
-		router.Disconnect()
+	// Disconnect all MIDI listeners, waiting for triggers in progress to complete.
+	var wg sync.WaitGroup
+	for _, router := range app.Config().MidiRouters {
+		wg.Add(1)
+		go func(router *MidiRouter) {
+			defer wg.Done()
+			router.Disconnect()
+		}(router)
 	}
+	wg.Wait()
 }
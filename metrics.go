@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics exposed on the HTTP server.
+var (
+	// Triggers fired by type, either note, http, mqtt, or api.
+	triggersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "midi_triggers_total",
+		Help: "Number of triggers fired.",
+	}, []string{"router", "type"})
+	// Outbound HTTP requests by response status, or error if the request failed.
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "midi_http_requests_total",
+		Help: "Number of outbound HTTP requests made by note triggers.",
+	}, []string{"router", "status"})
+	// Outbound HTTP request latency.
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "midi_http_request_duration_seconds",
+		Help:    "Latency of outbound HTTP requests made by note triggers.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"router"})
+	// MQTT messages published.
+	mqttPublishesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_publishes_total",
+		Help: "Number of MQTT messages published.",
+	}, []string{"router", "topic"})
+	// Results of each part of a trigger, either the firehose, note_topic, mqtt, osc, http, response, or webhook, by success or failure.
+	triggerResultsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "midi_trigger_results_total",
+		Help: "Number of MQTT publishes and HTTP requests of triggers by result.",
+	}, []string{"router", "leg", "result"})
+	// MIDI messages dropped for arriving within the minimum interval.
+	droppedMessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "midi_dropped_messages_total",
+		Help: "Number of MIDI messages dropped by the minimum interval.",
+	}, []string{"router", "type"})
+	// Trigger requests rejected by the rate limit.
+	rateLimitedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "midi_http_rate_limited_total",
+		Help: "Number of HTTP trigger requests rejected by the rate limit.",
+	})
+)
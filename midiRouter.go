@@ -1,18 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	mrand "math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/mux"
+	"github.com/hypebeast/go-osc/osc"
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/gomidi/midi/v2"
 	"gitlab.com/gomidi/midi/v2/drivers"
@@ -39,18 +56,70 @@ func (l LogLevel) String() string {
 	return [...]string{"Info", "Error", "Receive", "Send", "Debug"}[l]
 }
 
+// Provides the logrus level messages of a log level are logged at.
+func (l LogLevel) Level() log.Level {
+	switch l {
+	case ErrorLog:
+		return log.ErrorLevel
+	case DebugLog:
+		return log.DebugLevel
+	}
+	return log.InfoLevel
+}
+
+// Connection state of the MIDI ports of a router.
+type ConnectionState int32
+
+const (
+	// Not connected, and not trying to connect.
+	Disconnected ConnectionState = iota
+	// Looking for the device, and retrying until found.
+	Connecting
+	// Connected to the device.
+	Connected
+)
+
+// Provides a string value for a connection state.
+func (s ConnectionState) String() string {
+	return [...]string{"disconnected", "connecting", "connected"}[s]
+}
+
+// Encode the connection state as its string value.
+func (s ConnectionState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Maximum size of a request body read for MIDI info.
+const maxRequestBodySize = 64 * 1024
+
+// Maximum size of a trigger response body published to MQTT.
+const maxResponseSize = 64 * 1024
+
 // Configurations relating to MQTT connection.
 type MQTTConfig struct {
 	// Hostname of the MQTT broker.
 	Host string `fig:"host"`
 	// Port of the MQTT broker.
 	Port int `fig:"port"`
-	// MQTT client ID of this relay.
+	// MQTT client ID of this relay. If empty, one is generated from the hostname.
 	ClientId string `fig:"client_id"`
+	// Append a random suffix to the client ID, so instances sharing
+	// a configuration do not disconnect each other.
+	RandomClientIdSuffix bool `fig:"random_client_id_suffix"`
 	// User name used for MQTT authentication.
 	User string `fig:"user"`
 	// Password used for MQTT authentication.
 	Password string `fig:"password"`
+	// Connect to the MQTT broker using TLS.
+	UseTLS bool `fig:"use_tls"`
+	// Scheme of the broker URL, either tcp, ssl, ws, or wss. Defaults to ssl with TLS, otherwise tcp.
+	Scheme string `fig:"scheme"`
+	// Path of the broker URL, such as `/mqtt` for WebSocket brokers.
+	Path string `fig:"path"`
+	// Certificate authority file used to verify the broker certificate.
+	CAFile string `fig:"ca_file"`
+	// Should the broker certificate not be verified.
+	InsecureSkipVerify bool `fig:"insecure_skip_verify"`
 	// Topic where MQTT messages are pushed and received.
 	// Set topic to `midi/example` and the following topics will be setup.
 	// midi/example/cmd - Any commands received on MIDI will publish here.
@@ -62,66 +131,871 @@ type MQTTConfig struct {
 	DisableMidiFirehose bool `fig:"disable_midi_firehose"`
 	// Disables the config send.
 	DisableConfigSend bool `fig:"disable_config_send"`
+	// Quality of service level for published messages.
+	QoS byte `fig:"qos"`
+	// Should published midi messages be retained by the broker.
+	// The status topic is always retained.
+	Retain bool `fig:"retain"`
+	// Topic where `online` or `offline` is published, defaults to the status topic.
+	// The broker publishes `offline` if the connection is lost.
+	AvailabilityTopic string `fig:"availability_topic"`
+	// Publish Home Assistant MQTT discovery configs for triggers.
+	HomeAssistantDiscovery bool `fig:"home_assistant_discovery"`
+	// Forward clock and transport messages to midi/example/transport, with the clock
+	// published once per beat. Transport messages sent to midi/example/transport/send
+	// are forwarded to MIDI.
+	ForwardClock bool `fig:"forward_clock"`
+	// How often to ping the broker, to detect a lost connection.
+	KeepAlive time.Duration `fig:"keep_alive" default:"30s"`
+	// How long to wait for the broker to accept a connection.
+	ConnectTimeout time.Duration `fig:"connect_timeout" default:"30s"`
+	// Longest wait between reconnect attempts after a lost connection.
+	MaxReconnectInterval time.Duration `fig:"max_reconnect_interval" default:"1m"`
+	// Handle messages received in the order they arrive, one at a time.
+	OrderMatters *bool `fig:"order_matters" default:"true"`
+	// Limit of messages in flight when resuming publishing after a reconnect, or unlimited if 0.
+	MaxResumePubInFlight int `fig:"max_resume_pub_in_flight"`
+	// Republish the status at this interval as a heartbeat, or only on request if 0.
+	StatusInterval time.Duration `fig:"status_interval"`
+}
+
+// Get the topic availability is published to.
+func (c *MQTTConfig) GetAvailabilityTopic() string {
+	if c.AvailabilityTopic != "" {
+		return c.AvailabilityTopic
+	}
+	return c.Topic + "/status"
+}
+
+// Encode the config with the password redacted.
+func (c MQTTConfig) MarshalJSON() ([]byte, error) {
+	type config MQTTConfig
+	c.Password = redact(c.Password)
+	return json.Marshal(config(c))
+}
+
+// Make the client ID used to connect, generating a unique one if not configured.
+func (c *MQTTConfig) MakeClientID() string {
+	// Generate a short random suffix.
+	b := make([]byte, 3)
+	rand.Read(b)
+	suffix := hex.EncodeToString(b)
+
+	// Without a client ID, use the service name and hostname.
+	if c.ClientId == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "unknown"
+		}
+		return fmt.Sprintf("%s-%s-%s", serviceName, hostname, suffix)
+	}
+	if c.RandomClientIdSuffix {
+		return c.ClientId + "-" + suffix
+	}
+	return c.ClientId
+}
+
+// Get the scheme of the broker URL.
+func (c *MQTTConfig) GetScheme() string {
+	if c.Scheme != "" {
+		return c.Scheme
+	}
+	if c.UseTLS {
+		return "ssl"
+	}
+	return "tcp"
+}
+
+// Check if the broker connection uses TLS.
+func (c *MQTTConfig) IsTLS() bool {
+	scheme := c.GetScheme()
+	return c.UseTLS || scheme == "ssl" || scheme == "wss"
 }
 
-// Payload to decode/encode JSON message.
+// Make the URL of the MQTT broker.
+func (c *MQTTConfig) BrokerURL() string {
+	u := url.URL{
+		Scheme: c.GetScheme(),
+		Host:   net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		Path:   c.Path,
+	}
+	return u.String()
+}
+
+// Build the TLS configuration for connecting to the MQTT broker.
+func (c *MQTTConfig) TLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	// If a certificate authority is provided, use it to verify the broker.
+	if c.CAFile != "" {
+		ca, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// MessageType Definition
+type MessageType string
+
+const (
+	// Note on and off messages, the default when no type is set.
+	NoteMessage MessageType = "note"
+	// Note on messages, as received from MIDI.
+	NoteOnMessage MessageType = "note_on"
+	// Note off messages, as received from MIDI.
+	NoteOffMessage MessageType = "note_off"
+	// Program change messages.
+	ProgramChangeMessage MessageType = "program_change"
+	// Control change messages.
+	ControlChangeMessage MessageType = "control_change"
+	// Pitch bend messages.
+	PitchBendMessage MessageType = "pitch_bend"
+	// Channel pressure messages.
+	AfterTouchMessage MessageType = "aftertouch"
+	// Polyphonic key pressure messages.
+	PolyAfterTouchMessage MessageType = "poly_aftertouch"
+	// System exclusive messages.
+	SysExMessage MessageType = "sysex"
+)
+
+// Get the message type, defaulting to note when not set, and with note on and off as note.
+func (t MessageType) OrDefault() MessageType {
+	switch t {
+	case "", NoteOnMessage, NoteOffMessage:
+		return NoteMessage
+	}
+	return t
+}
+
+// Check if the message type is supported.
+func (t MessageType) IsValid() bool {
+	switch t.OrDefault() {
+	case NoteMessage, ProgramChangeMessage, ControlChangeMessage, PitchBendMessage,
+		AfterTouchMessage, PolyAfterTouchMessage, SysExMessage:
+		return true
+	}
+	return false
+}
+
+// Payload to decode/encode JSON message, with the fields used depending on the type.
+// Encoded messages always have a type, with notes being either note_on or note_off,
+// and only the fields of that type. Messages decoded may leave the type empty for notes.
 type MQTTPayload struct {
-	Channel  uint8 `json:"channel"`
-	Note     uint8 `json:"note"`
-	Velocity uint8 `json:"velocity"`
+	Type       MessageType `json:"type"`
+	Channel    uint8       `json:"channel"`
+	Note       uint8       `json:"note"`
+	Velocity   uint8       `json:"velocity"`
+	Program    uint8       `json:"program,omitempty"`
+	Controller uint8       `json:"controller,omitempty"`
+	Value      uint8       `json:"value,omitempty"`
+	// Pitch bend value from -8192 to 8191, with 0 being center.
+	Bend int16 `json:"bend,omitempty"`
+	// Pressure of aftertouch messages.
+	Pressure uint8 `json:"pressure,omitempty"`
+	// Bytes of system exclusive messages, without the start and end bytes. Encoded as base64.
+	SysEx []byte `json:"sysex,omitempty"`
+	// Name of the input device the message was received from.
+	Source string `json:"source,omitempty"`
+	// Relative timestamp from the MIDI driver in milliseconds when the message was received.
+	Timestamp int32 `json:"timestamp"`
+
+	// If a note off was received as a note on with a velocity of 0.
+	zeroVelocityNoteOn bool
+	// Number of the first channel when displayed, either 0 or 1.
+	channelBase uint8
+}
+
+// JSON encoding of a message, with only the fields of its type.
+type payloadJSON struct {
+	Type       string `json:"type"`
+	Channel    *uint8 `json:"channel,omitempty"`
+	Note       *uint8 `json:"note,omitempty"`
+	Velocity   *uint8 `json:"velocity,omitempty"`
+	Program    *uint8 `json:"program,omitempty"`
+	Controller *uint8 `json:"controller,omitempty"`
+	Value      *uint8 `json:"value,omitempty"`
+	Bend       *int16 `json:"bend,omitempty"`
+	Pressure   *uint8 `json:"pressure,omitempty"`
+	SysEx      []byte `json:"sysex,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Timestamp  int32  `json:"timestamp"`
+}
+
+// Get the JSON encoding fields of the message type.
+func (p MQTTPayload) jsonFields() payloadJSON {
+	out := payloadJSON{
+		Type:      p.TypeName(),
+		Channel:   &p.Channel,
+		Source:    p.Source,
+		Timestamp: p.Timestamp,
+	}
+	switch p.Type.OrDefault() {
+	case ProgramChangeMessage:
+		out.Program = &p.Program
+	case ControlChangeMessage:
+		out.Controller = &p.Controller
+		out.Value = &p.Value
+	case PitchBendMessage:
+		out.Bend = &p.Bend
+	case AfterTouchMessage:
+		out.Pressure = &p.Pressure
+	case PolyAfterTouchMessage:
+		out.Note = &p.Note
+		out.Pressure = &p.Pressure
+	case SysExMessage:
+		out.Channel = nil
+		out.SysEx = p.SysEx
+	default:
+		out.Note = &p.Note
+		out.Velocity = &p.Velocity
+	}
+	return out
+}
+
+// Encode the message with only the fields of its type.
+func (p MQTTPayload) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.jsonFields())
+}
+
+// Decode a message, keeping the current values of fields not provided.
+func (p *MQTTPayload) UnmarshalJSON(data []byte) error {
+	// Decode without this method, to use the default field decoding.
+	type payload MQTTPayload
+	return json.Unmarshal(data, (*payload)(p))
+}
+
+// Get the channel as displayed, numbered from the channel base.
+func (p MQTTPayload) displayChannel() uint8 {
+	return p.Channel + p.channelBase
+}
+
+// Provides a human readable description of the message for logging.
+func (p MQTTPayload) String() string {
+	switch p.Type {
+	case NoteOnMessage:
+		return fmt.Sprintf("starting note %s(%d) on channel %v with velocity %v", midi.Note(p.Note), p.Note, p.displayChannel(), p.Velocity)
+	case NoteOffMessage:
+		return fmt.Sprintf("ending note %s(%d) on channel %v", midi.Note(p.Note), p.Note, p.displayChannel())
+	case ProgramChangeMessage:
+		return fmt.Sprintf("program change %d on channel %v", p.Program, p.displayChannel())
+	case ControlChangeMessage:
+		return fmt.Sprintf("control change %d on channel %v with value %v", p.Controller, p.displayChannel(), p.Value)
+	case PitchBendMessage:
+		return fmt.Sprintf("pitch bend %d on channel %v", p.Bend, p.displayChannel())
+	case AfterTouchMessage:
+		return fmt.Sprintf("aftertouch %d on channel %v", p.Pressure, p.displayChannel())
+	case PolyAfterTouchMessage:
+		return fmt.Sprintf("aftertouch %d for note %s(%d) on channel %v", p.Pressure, midi.Note(p.Note), p.Note, p.displayChannel())
+	case SysExMessage:
+		return fmt.Sprintf("sysex % X", p.SysEx)
+	default:
+		return fmt.Sprintf("note %s(%d) on channel %v with velocity %v", midi.Note(p.Note), p.Note, p.displayChannel(), p.Velocity)
+	}
+}
+
+// Provides the name of the MIDI message type, distinguishing note on and off.
+func (p MQTTPayload) TypeName() string {
+	if p.Type.OrDefault() == NoteMessage {
+		if p.IsNoteOn() {
+			return string(NoteOnMessage)
+		}
+		return string(NoteOffMessage)
+	}
+	return string(p.Type)
+}
+
+// Provides structured log fields of the message.
+func (p MQTTPayload) Fields() log.Fields {
+	fields := log.Fields{
+		"type":    p.TypeName(),
+		"channel": p.displayChannel(),
+	}
+	switch p.Type.OrDefault() {
+	case NoteMessage:
+		fields["note"] = p.Note
+		fields["velocity"] = p.Velocity
+	case ProgramChangeMessage:
+		fields["program"] = p.Program
+	case ControlChangeMessage:
+		fields["controller"] = p.Controller
+		fields["value"] = p.Value
+	case PitchBendMessage:
+		fields["bend"] = p.Bend
+	case AfterTouchMessage:
+		fields["pressure"] = p.Pressure
+	case PolyAfterTouchMessage:
+		fields["note"] = p.Note
+		fields["pressure"] = p.Pressure
+	case SysExMessage:
+		delete(fields, "channel")
+		fields["sysex"] = fmt.Sprintf("% X", p.SysEx)
+	}
+	if p.Source != "" {
+		fields["source"] = p.Source
+	}
+	return fields
+}
+
+// Check if the message turns on a note.
+func (p MQTTPayload) IsNoteOn() bool {
+	return p.Type.OrDefault() == NoteMessage && p.Type != NoteOffMessage && p.Velocity != 0
+}
+
+// Check the values are within the MIDI range, as they would otherwise wrap into other bytes of the message.
+func (p MQTTPayload) CheckRange() error {
+	if p.Channel > 15 {
+		return fmt.Errorf("channel must be a number from 0 to 15")
+	}
+	// Check in a fixed order, so the same field is reported when several are out of range.
+	for _, field := range []struct {
+		key   string
+		value uint8
+	}{
+		{"note", p.Note},
+		{"velocity", p.Velocity},
+		{"program", p.Program},
+		{"controller", p.Controller},
+		{"value", p.Value},
+		{"pressure", p.Pressure},
+	} {
+		if field.value > maxMidiValue {
+			return fmt.Errorf("%s must be a number from 0 to %d", field.key, maxMidiValue)
+		}
+	}
+	if p.Bend < -8192 || p.Bend > 8191 {
+		return fmt.Errorf("bend must be a number from -8192 to 8191")
+	}
+	return checkSysEx(p.SysEx)
+}
+
+// Make the MIDI message based on information.
+func (p MQTTPayload) MidiMessage() midi.Message {
+	switch p.Type {
+	case ProgramChangeMessage:
+		return midi.ProgramChange(p.Channel, p.Program)
+	case ControlChangeMessage:
+		return midi.ControlChange(p.Channel, p.Controller, p.Value)
+	case PitchBendMessage:
+		return midi.Pitchbend(p.Channel, p.Bend)
+	case AfterTouchMessage:
+		return midi.AfterTouch(p.Channel, p.Pressure)
+	case PolyAfterTouchMessage:
+		return midi.PolyAfterTouch(p.Channel, p.Note, p.Pressure)
+	case SysExMessage:
+		return midi.SysEx(p.SysEx)
+	default:
+		if !p.IsNoteOn() {
+			return midi.NoteOff(p.Channel, p.Note)
+		}
+		return midi.NoteOn(p.Channel, p.Note, p.Velocity)
+	}
 }
 
 // Triggers that occur from MIDI messages received.
 type NoteTrigger struct {
+	// Type of message to match, either note, program_change, control_change, pitch_bend, aftertouch,
+	// poly_aftertouch, or sysex. Defaults to note.
+	MessageType MessageType `fig:"message_type"`
 	// Channel to match.
 	Channel uint8 `fig:"channel"`
 	// If we should match all channel values.
 	MatchAllChannels bool `fig:"match_all_channels"`
-	// Note to match.
-	Note uint8 `fig:"note"`
+	// Note to match, as a number or name.
+	Note NoteNumber `fig:"note"`
 	// If we should match all note values.
 	MatchAllNotes bool `fig:"match_all_notes"`
+	// Range of notes to match, used instead of note when either is set. A max of 0 has no upper bound.
+	NoteMin NoteNumber `fig:"note_min"`
+	NoteMax NoteNumber `fig:"note_max"`
 	// Velocity to match.
 	Velocity uint8 `fig:"velocity"`
 	// If we should match all velocity values.
 	MatchAllVelocities bool `fig:"match_all_velocities"`
+	// Range of velocities to match, used instead of velocity when either is set, and also applied
+	// when matching all velocities. A max of 0 has no upper bound, so a min alone filters out ghost notes.
+	VelocityMin uint8 `fig:"velocity_min"`
+	VelocityMax uint8 `fig:"velocity_max"`
+	// Only match note off messages, not note on messages with a velocity of 0.
+	MatchNoteOffOnly bool `fig:"match_note_off_only"`
+	// Only match note on messages, including those with a velocity of 0.
+	MatchNoteOnOnly bool `fig:"match_note_on_only"`
+	// Program to match for program change messages.
+	Program uint8 `fig:"program"`
+	// If we should match all program values.
+	MatchAllPrograms bool `fig:"match_all_programs"`
+	// Controller and value to match for control change messages.
+	Controller uint8 `fig:"controller"`
+	Value      uint8 `fig:"value"`
+	// If we should match all controllers.
+	MatchAllControllers bool `fig:"match_all_controllers"`
+	// Pitch bend value to match, from -8192 to 8191 with 0 being center.
+	Bend int16 `fig:"bend"`
+	// Aftertouch pressure to match.
+	Pressure uint8 `fig:"pressure"`
+	// If we should match all control change, pitch bend, or pressure values.
+	MatchAllValues bool `fig:"match_all_values"`
+	// Hex prefix of system exclusive messages to match, such as the manufacturer ID `43`.
+	// Empty matches all system exclusive messages.
+	SysExPrefix string `fig:"sysex_prefix"`
+	// Scale the velocity of note on messages before it is sent in requests.
+	VelocityScale VelocityScale `fig:"velocity_scale"`
+	// Send the message matched to the output device of the router.
+	ForwardToOutput bool `fig:"forward_to_output"`
+	// Channel of the message sent in requests and forwarded, instead of the channel received, if set.
+	OutputChannel *uint8 `fig:"output_channel"`
+	// Note of the message forwarded, instead of the note received, if set.
+	OutputNote *NoteNumber `fig:"output_note"`
+	// Log an error combining the failures of the MQTT publish, OSC message, and HTTP request, if any fails.
+	RequireAllSucceed bool `fig:"require_all_succeed"`
+	// Ignore repeated matches of the same channel and note within this duration.
+	Debounce time.Duration `fig:"debounce"`
+	// Send only the latest message matched of the same channel and note or controller, once none are
+	// received for this duration, such as the final value of a sweep. Unlike debounce, the last is always sent.
+	Coalesce time.Duration `fig:"coalesce"`
+	// Regular expression of the input devices to match messages from.
+	// Only used when listening to all matching devices.
+	SourceDevice string `fig:"source_device"`
+	// Log level of messages for this trigger, overriding the router log level if set.
+	LogLevel *LogLevel `fig:"log_level"`
 	// Allow delaying the request.
 	DelayBefore time.Duration `fig:"delay_before"`
-	DelayAfter  time.Duration `fig:"deplay_after"`
+	DelayAfter  time.Duration `fig:"delay_after"`
+	// Add a random delay up to this duration to the delay before, so triggers do not fire in lockstep.
+	DelayJitter time.Duration `fig:"delay_jitter"`
+	// Ranges of the local time of day, such as 08:00-22:00, the trigger is active in, or always if empty.
+	ActiveHours []TimeRange `fig:"active_hours"`
+	// Deprecated misspelling of delay_after, to be removed in a future release.
+	DeprecatedDelayAfter time.Duration `fig:"deplay_after" json:"-"`
 	// Custom MQTT message. Do not set to ignore MQTT.
+	// Templates such as `{{.Note}}` are replaced with the MIDI info.
 	MqttTopic string `fig:"mqtt_topic"`
-	// Nil payload will generate a payload with midi info.
+	// Nil payload will generate a payload with midi info. Templates such as `{{.Note}}`
+	// within strings are replaced with the MIDI info. A string payload with templates
+	// is published as is, other payloads are published as JSON.
 	MqttPayload interface{} `fig:"mqtt_payload"`
+	// Override the router quality of service level for this trigger.
+	MqttQoS *byte `fig:"mqtt_qos"`
+	// Override the router retain setting for this trigger.
+	MqttRetain *bool `fig:"mqtt_retain"`
 	// If the HTTP request should includ midi info.
 	MidiInfoInRequest bool `fig:"midi_info_in_request"`
+	// Absolute MQTT topic to publish the body of successful HTTP responses to.
+	ResponseToMqttTopic string `fig:"response_to_mqtt_topic"`
+	// OSC address to send a message to, such as `/cue/{{.Note}}/start`. Do not set to ignore OSC.
+	OscAddress string `fig:"osc_address"`
+	// Arguments of the OSC message, with templates such as `{{.Velocity}}` replaced with the MIDI info.
+	// Defaults to the MIDI info, such as the channel, note, and velocity of note messages.
+	OscArguments []string `fig:"osc_arguments"`
 	// Should SSL requests require a valid certificate.
 	InsecureSkipVerify bool `fig:"insecure_skip_verify"`
 	// The URL to call with the HTTP request. Do not set if you wish to not send HTTP request.
+	// Templates such as `{{.Note}}` are replaced with the MIDI info.
 	URL string `fig:"url"`
 	// HTTP method, defaults to GET.
 	Method string `fig:"method"`
-	// HTTP body.
+	// HTTP body, templates such as `{{.Velocity}}` are replaced with the MIDI info.
 	Body string `fig:"body"`
-	// HTTP headers.
+	// HTTP headers, each with either a single value or a list of values.
+	// If no content type is set and the body is JSON, it is sent as application/json.
 	Headers http.Header `fig:"headers"`
+	// Basic authentication credentials for the HTTP request.
+	BasicAuthUser     string `fig:"basic_auth_user"`
+	BasicAuthPassword string `fig:"basic_auth_password"`
+	// Bearer token sent in the Authorization header of the HTTP request.
+	BearerToken string `fig:"bearer_token"`
+	// How long to wait for the HTTP request to complete.
+	Timeout time.Duration `fig:"timeout" default:"30s"`
+	// How many times to retry a failed HTTP request.
+	Retries int `fig:"retries"`
+	// How long to wait before the first retry, doubling after each retry.
+	RetryBackoff time.Duration `fig:"retry_backoff" default:"1s"`
+
+	// Parsed source device regular expression.
+	sourceDeviceRx *regexp.Regexp
+	// Parsed templates of the MQTT topic, URL, and body.
+	topicTemplate    *template.Template
+	urlTemplate      *template.Template
+	bodyTemplate     *template.Template
+	payloadTemplates map[string]*template.Template
+	// Parsed templates of the OSC address and arguments.
+	oscAddressTemplate   *template.Template
+	oscArgumentTemplates []*template.Template
+}
+
+// Encode the trigger with the credentials redacted.
+func (t NoteTrigger) MarshalJSON() ([]byte, error) {
+	type trigger NoteTrigger
+	t.BasicAuthPassword = redact(t.BasicAuthPassword)
+	t.BearerToken = redact(t.BearerToken)
+	t.Headers = redactHeader(t.Headers)
+	return json.Marshal(trigger(t))
+}
+
+// Parse the templates and regular expressions of this trigger, so they are not parsed on every message.
+func (t *NoteTrigger) ParseTemplates() error {
+	var err error
+	if t.SourceDevice != "" {
+		t.sourceDeviceRx, err = regexp.Compile(t.SourceDevice)
+		if err != nil {
+			return fmt.Errorf("source device regexp: %v", err)
+		}
+	}
+	t.topicTemplate, err = parseTemplate("mqtt_topic", t.MqttTopic)
+	if err != nil {
+		return fmt.Errorf("mqtt topic template: %v", err)
+	}
+	t.urlTemplate, err = parseTemplate("url", t.URL)
+	if err != nil {
+		return fmt.Errorf("url template: %v", err)
+	}
+	t.bodyTemplate, err = parseTemplate("body", t.Body)
+	if err != nil {
+		return fmt.Errorf("body template: %v", err)
+	}
+	t.payloadTemplates = make(map[string]*template.Template)
+	err = parsePayloadTemplates(t.MqttPayload, t.payloadTemplates)
+	if err != nil {
+		return fmt.Errorf("mqtt payload template: %v", err)
+	}
+	t.oscAddressTemplate, err = parseTemplate("osc_address", t.OscAddress)
+	if err != nil {
+		return fmt.Errorf("osc address template: %v", err)
+	}
+	t.oscArgumentTemplates = make([]*template.Template, len(t.OscArguments))
+	for i, arg := range t.OscArguments {
+		t.oscArgumentTemplates[i], err = parseTemplate("osc_argument", arg)
+		if err != nil {
+			return fmt.Errorf("osc argument %d template: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Copy headers from the config, which may not have canonical keys.
+func copyHeader(src http.Header) http.Header {
+	header := make(http.Header)
+	for key, values := range src {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	return header
+}
+
+// User agent of requests, unless set in the headers.
+const userAgent = serviceName + "/" + serviceVersion
+
+// Build the request headers, defaulting the user agent and the content type of bodies.
+func (t *NoteTrigger) RequestHeader(body string) http.Header {
+	header := copyHeader(t.Headers)
+	if header.Get("User-Agent") == "" {
+		header.Set("User-Agent", userAgent)
+	}
+	if header.Get("Content-Type") == "" && body != "" {
+		trimmed := strings.TrimSpace(body)
+		if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+			header.Set("Content-Type", "application/json")
+		} else {
+			header.Set("Content-Type", "text/plain")
+		}
+	}
+	return header
+}
+
+// Check if a note matches this trigger, by range if set, with a max of 0 being no upper bound.
+func (t *NoteTrigger) matchesNote(note uint8) bool {
+	if t.MatchAllNotes {
+		return true
+	}
+	if t.NoteMin != 0 || t.NoteMax != 0 {
+		upper := t.NoteMax
+		if upper == 0 {
+			upper = maxMidiValue
+		}
+		return NoteNumber(note) >= t.NoteMin && NoteNumber(note) <= upper
+	}
+	return t.Note == NoteNumber(note)
+}
+
+// Check if a MIDI message matches this trigger.
+func (t *NoteTrigger) Matches(msg MQTTPayload) bool {
+	channel, note, velocity := msg.Channel, msg.Note, msg.Velocity
+
+	// System exclusive messages have no channel, so match by prefix.
+	if t.MessageType == SysExMessage || msg.Type == SysExMessage {
+		if t.MessageType != msg.Type {
+			return false
+		}
+		prefix, err := hex.DecodeString(strings.ReplaceAll(t.SysExPrefix, " ", ""))
+		return err == nil && bytes.HasPrefix(msg.SysEx, prefix)
+	}
+
+	// Check the channel.
+	if t.Channel != channel && !t.MatchAllChannels {
+		return false
+	}
+
+	// Messages only match triggers of the same type.
+	if t.MessageType.OrDefault() != msg.Type.OrDefault() {
+		return false
+	}
+	// Triggers for only note on or off messages match by name.
+	if (t.MessageType == NoteOnMessage || t.MessageType == NoteOffMessage) && string(t.MessageType) != msg.TypeName() {
+		return false
+	}
+	// Triggers may distinguish note offs sent as note on messages with a velocity of 0.
+	if t.MatchNoteOffOnly && (msg.Type != NoteOffMessage || msg.zeroVelocityNoteOn) {
+		return false
+	}
+	if t.MatchNoteOnOnly && msg.Type != NoteOnMessage && !msg.zeroVelocityNoteOn {
+		return false
+	}
+	switch msg.Type {
+	case ProgramChangeMessage:
+		return t.Program == msg.Program || t.MatchAllPrograms
+	case ControlChangeMessage:
+		return (t.Controller == msg.Controller || t.MatchAllControllers) && (t.Value == msg.Value || t.MatchAllValues)
+	case PitchBendMessage:
+		return t.Bend == msg.Bend || t.MatchAllValues
+	case AfterTouchMessage:
+		return t.Pressure == msg.Pressure || t.MatchAllValues
+	case PolyAfterTouchMessage:
+		return t.matchesNote(note) && (t.Pressure == msg.Pressure || t.MatchAllValues)
+	}
+
+	// Check the note.
+	if !t.matchesNote(note) {
+		return false
+	}
+
+	// Check the velocity, by range if set.
+	if t.VelocityMin != 0 || t.VelocityMax != 0 {
+		return t.matchesVelocityRange(velocity)
+	}
+	return t.MatchAllVelocities || t.Velocity == velocity
+}
+
+// Check if the velocity is within the velocity range, with a max of 0 being no upper bound.
+func (t *NoteTrigger) matchesVelocityRange(velocity uint8) bool {
+	upper := t.VelocityMax
+	if upper == 0 {
+		upper = maxMidiValue
+	}
+	return velocity >= t.VelocityMin && velocity <= upper
 }
 
 // Triggers that occur from HTTP or MQTT messsages received.
 type RequestTrigger struct {
-	Channel  uint8 `fig:"channel"`
-	Note     uint8 `fig:"note"`
-	Velocity uint8 `fig:"velocity"`
-	// Parse midi notes from HTTP request.
+	// Type of message to send, either note, program_change, control_change, pitch_bend,
+	// aftertouch, poly_aftertouch, or sysex. Defaults to note.
+	MessageType MessageType `fig:"message_type"`
+	Channel     uint8       `fig:"channel"`
+	// Note to send, as a number or name.
+	Note     NoteNumber `fig:"note"`
+	Velocity uint8      `fig:"velocity"`
+	// Program to send for program change messages.
+	Program uint8 `fig:"program"`
+	// Controller and value to send for control change messages.
+	Controller uint8 `fig:"controller"`
+	Value      uint8 `fig:"value"`
+	// Pitch bend value to send, from -8192 to 8191 with 0 being center.
+	Bend int16 `fig:"bend"`
+	// Pressure to send for aftertouch messages.
+	Pressure uint8 `fig:"pressure"`
+	// System exclusive bytes to send as hex, such as `43 10 4C`, without the start and end bytes.
+	SysEx string `fig:"sysex"`
+	// Parse midi notes from HTTP request query, or JSON body.
 	MidiInfoInRequest bool `fig:"midi_info_in_request"`
 	// Absolute MQTT topic to subscribe.
 	MqttTopic string `fig:"mqtt_topic"`
 	// Sub topic off relay MQTT topic to subscribe.
 	// midi/example/$SUB_TOPIC
 	MqttSubTopic string `fig:"mqtt_sub_topic"`
+	// OSC address to trigger with, which messages received may match by pattern.
+	OscAddress string `fig:"osc_address"`
 	// Rather or not to disallow payload to be relayed.
 	DisallowPayload bool `fig:"disallow_payload"`
+	// Log level of messages for this trigger, overriding the router log level if set.
+	LogLevel *LogLevel `fig:"log_level"`
 	// Request URL path to trigger with.
 	URI string `fig:"uri"`
+	// Channel of the MIDI messages sent, instead of the channel requested, if set.
+	OutputChannel *uint8 `fig:"output_channel"`
+	// HTTP methods which may trigger, such as POST, or any method if empty.
+	AllowedMethods []string `fig:"allowed_methods"`
+	// Request URL path pattern to trigger with, variables such as `/note/{note:[0-9]+}`
+	// set the MIDI info of the same name.
+	URIPattern string `fig:"uri_pattern"`
+	// Scale the velocity received in requests back to the MIDI range.
+	VelocityScale VelocityScale `fig:"velocity_scale"`
+	// How long to hold the note before sending a note off. Zero leaves the note on.
+	Duration time.Duration `fig:"duration"`
+	// Respond with the MIDI message sent as JSON, instead of no content.
+	RespondWithMidiInfo bool `fig:"respond_with_midi_info"`
+	// HTTP status of successful responses without MIDI info.
+	SuccessStatus int `fig:"success_status" default:"204"`
+	// Messages to send in order, instead of the single message above.
+	Sequence []MessageSpec `fig:"sequence"`
+}
+
+// A message sent as part of a sequence.
+type MessageSpec struct {
+	// Type of message to send, defaults to note.
+	MessageType MessageType `fig:"message_type"`
+	Channel     uint8       `fig:"channel"`
+	Note        NoteNumber  `fig:"note"`
+	Velocity    uint8       `fig:"velocity"`
+	Program     uint8       `fig:"program"`
+	Controller  uint8       `fig:"controller"`
+	Value       uint8       `fig:"value"`
+	Bend        int16       `fig:"bend"`
+	Pressure    uint8       `fig:"pressure"`
+	SysEx       string      `fig:"sysex"`
+	// How long to wait after the previous message before sending this one.
+	Delay time.Duration `fig:"delay"`
+}
+
+// Make the payload of the message.
+func (s *MessageSpec) Payload() MQTTPayload {
+	// Invalid system exclusive bytes are caught by config validation, so are ignored here.
+	sysex, _ := decodeSysExHex(s.SysEx)
+	return MQTTPayload{
+		Type:       s.MessageType,
+		Channel:    s.Channel,
+		Note:       uint8(s.Note),
+		Velocity:   s.Velocity,
+		Program:    s.Program,
+		Controller: s.Controller,
+		Value:      s.Value,
+		Bend:       s.Bend,
+		Pressure:   s.Pressure,
+		SysEx:      sysex,
+	}
+}
+
+// Set the channel of a message to the output channel, if set.
+func (t *RequestTrigger) remapChannel(p *MQTTPayload) {
+	if t.OutputChannel != nil && p.Type != SysExMessage {
+		p.Channel = *t.OutputChannel
+	}
+}
+
+// Check if the HTTP method may trigger this trigger.
+func (t *RequestTrigger) AllowsMethod(method string) bool {
+	if len(t.AllowedMethods) == 0 {
+		return true
+	}
+	for _, allowed := range t.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Update the message to the MIDI info values provided, such as from a request query,
+// returning an error if a value is not valid. Empty values are ignored.
+func (p *MQTTPayload) ParseValues(values url.Values) error {
+	vars := make(map[string]string)
+	for _, key := range []string{"channel", "note", "velocity", "program", "controller", "value", "bend", "sysex", "pressure"} {
+		if value := values.Get(key); value != "" {
+			vars[key] = value
+		}
+	}
+	return p.ParseVars(vars)
+}
+
+// Update the message to the URI pattern variables named after MIDI info,
+// returning an error if a value is not a number in range. The channel is numbered from the channel base.
+func (p *MQTTPayload) ParseVars(vars map[string]string) error {
+	// Parse an integer variable if set, checking it is in range.
+	parse := func(key string, min, max int) (int, bool, error) {
+		value, ok := vars[key]
+		if !ok {
+			return 0, false, nil
+		}
+		i, err := strconv.Atoi(value)
+		if err != nil || i < min || i > max {
+			return 0, false, fmt.Errorf("%s must be a number from %d to %d", key, min, max)
+		}
+		return i, true, nil
+	}
+
+	base := int(p.channelBase)
+	if i, ok, err := parse("channel", base, 15+base); err != nil {
+		return err
+	} else if ok {
+		p.Channel = uint8(i - base)
+	}
+	if value, ok := vars["note"]; ok {
+		var note NoteNumber
+		if err := note.UnmarshalString(value); err != nil {
+			return err
+		}
+		p.Note = uint8(note)
+	}
+	for key, field := range map[string]*uint8{
+		"velocity":   &p.Velocity,
+		"program":    &p.Program,
+		"controller": &p.Controller,
+		"value":      &p.Value,
+		"pressure":   &p.Pressure,
+	} {
+		if i, ok, err := parse(key, 0, maxMidiValue); err != nil {
+			return err
+		} else if ok {
+			*field = uint8(i)
+		}
+	}
+	if i, ok, err := parse("bend", -8192, 8191); err != nil {
+		return err
+	} else if ok {
+		p.Bend = int16(i)
+	}
+	if value, ok := vars["sysex"]; ok {
+		sysex, err := decodeSysExBase64(value)
+		if err != nil {
+			return err
+		}
+		p.SysEx = sysex
+	}
+	return nil
+}
+
+// Make the payload of the message this trigger sends by default.
+func (t *RequestTrigger) Payload() MQTTPayload {
+	// Invalid system exclusive bytes are caught by config validation, so are ignored here.
+	sysex, _ := decodeSysExHex(t.SysEx)
+	return MQTTPayload{
+		Type:       t.MessageType,
+		Channel:    t.Channel,
+		Note:       uint8(t.Note),
+		Velocity:   t.Velocity,
+		Program:    t.Program,
+		Controller: t.Controller,
+		Value:      t.Value,
+		Bend:       t.Bend,
+		Pressure:   t.Pressure,
+		SysEx:      sysex,
+	}
+}
+
+// Topic which note messages of a note are published to.
+type NoteTopic struct {
+	// Note to publish, as a number or name.
+	Note NoteNumber `fig:"note"`
+	// Channel to publish the note of, or all channels if not set.
+	Channel *uint8 `fig:"channel"`
+	// Absolute MQTT topic to publish the message to.
+	Topic string `fig:"topic"`
 }
 
 // A common router for both receiving and sending MIDI messages.
@@ -130,14 +1004,44 @@ type MidiRouter struct {
 	Name string `fig:"name"`
 	// Midi device to connect, accepts regular expression.
 	Device string `fig:"device"`
+	// Match the whole device name, instead of any part of it.
+	DeviceExact bool `fig:"device_exact"`
+	// Match the device name regardless of case.
+	DeviceCaseInsensitive bool `fig:"device_case_insensitive"`
+	// Leave the router in the configuration without connecting it.
+	Disabled bool `fig:"disabled"`
 	// MQTT Connection if you are to integrate with MQTT.
 	MQTT MQTTConfig `fig:"mqtt"`
+	// OSC messages sent and received over UDP, if you are to integrate with OSC.
+	OSC OSCConfig `fig:"osc"`
 	// Only connect for sending notes, not receiving.
 	DisableListener bool `fig:"disable_listener"`
+	// Create virtual in and out ports for other software to connect to,
+	// instead of opening the device. Not supported on Windows.
+	VirtualPort bool `fig:"virtual_port"`
+	// Name of the virtual ports, defaults to the router name.
+	VirtualPortName string `fig:"virtual_port_name"`
+	// When more than one device matches, use the last instead of the first.
+	UseLastMatchingDevice bool `fig:"use_last_matching_device"`
+	// Listen to every input device matching, instead of only one.
+	ListenAllMatchingDevices bool `fig:"listen_all_matching_devices"`
+	// Wait between attempts to connect to the device, doubling after each failure up to the max.
+	ReconnectInterval    time.Duration `fig:"reconnect_interval" default:"1s"`
+	MaxReconnectInterval time.Duration `fig:"max_reconnect_interval" default:"1m"`
+	// Stop retrying after this many failed attempts, or retry forever if 0.
+	MaxReconnectAttempts int `fig:"max_reconnect_attempts"`
+	// Wait before first connecting to devices, for interfaces which are not ready when the service starts.
+	StartupDelay time.Duration `fig:"startup_delay"`
+	// Wait after opening input devices before listening, for interfaces which need time to settle.
+	DeviceSettleTime time.Duration `fig:"device_settle_time"`
+	// How often to check the connected devices are still present, reconnecting if one was removed.
+	DeviceCheckInterval time.Duration `fig:"device_check_interval" default:"5s"`
 	// Listener triggers for notes to send HTTP and or MQTT messages.
 	NoteTriggers []NoteTrigger `fig:"note_triggers"`
 	// HTTP and or MQTT triggers to send MIDI notes.
 	RequestTriggers []RequestTrigger `fig:"request_triggers"`
+	// Topics to publish note messages of each note to, without a trigger for each note.
+	NoteTopicMap []NoteTopic `fig:"note_topic_map"`
 
 	// How much logging.
 	// 0 - Info
@@ -146,474 +1050,2126 @@ type MidiRouter struct {
 	// 3 - MQTT, HTTP, and MIDI send logging.
 	// 4 - Debug
 	LogLevel LogLevel `fig:"log_level"`
+	// Webhook which receives every MIDI message received.
+	FirehoseWebhook FirehoseWebhook `fig:"firehose_webhook"`
+	// Drop MIDI messages received within this interval of the last of the same type.
+	MinInterval time.Duration `fig:"min_interval"`
+	// Log the requests, MQTT messages, and MIDI messages which would be sent, without sending them.
+	DryRun bool `fig:"dry_run"`
+	// How many note triggers may run at once, so a slow or delayed trigger does not hold up others.
+	// With 1, triggers run one after another in the order received.
+	MaxConcurrentTriggers int `fig:"max_concurrent_triggers" default:"8"`
+	// Send consecutive messages of a sequence with the same status as one write using
+	// MIDI running status, omitting the repeated status bytes.
+	RunningStatus bool `fig:"running_status"`
+	// Number of the first MIDI channel in logs and request query values, either 0 or 1,
+	// as devices often display channels from 1 to 16 while they are sent from 0 to 15.
+	ChannelDisplayBase uint8 `fig:"channel_display_base"`
+	// Also send all sound off when sending a panic, which silences notes still releasing.
+	PanicAllSoundOff bool `fig:"panic_all_sound_off"`
+	// How long to wait for triggers in progress to complete when disconnecting.
+	ShutdownGracePeriod time.Duration `fig:"shutdown_grace_period" default:"30s"`
 
 	// Connection to MIDI device.
-	MidiOut drivers.Out `fig:"-"`
-	// Function to stop listening to MIDI device.
-	ListenerStop func() `fig:"-"`
+	MidiOut MidiOutPort `fig:"-" json:"-"`
+	// Functions to stop listening to each MIDI device.
+	ListenerStops []func() `fig:"-" json:"-"`
 	// The client connection to MQTT.
-	MqttClient mqtt.Client `fig:"-"`
+	MqttClient mqtt.Client `fig:"-" json:"-"`
+	// Guards the output device, listener stop functions, input device names, and MQTT client,
+	// which are replaced on reconnects.
+	portsMu sync.RWMutex
+
+	// Client sending OSC messages, and the connection listening for them.
+	oscClient *osc.Client
+	oscConn   net.PacketConn
+
+	// HTTP clients shared between triggers with the same client settings.
+	httpClients   map[httpClientKey]*http.Client
+	httpClientsMu sync.Mutex
+	// Requests being processed, allowing disconnects to drain them.
+	inFlight sync.WaitGroup
+	// Set once disconnecting, so no new requests are started while draining.
+	closing    bool
+	inFlightMu sync.Mutex
+	// Queue of note triggers waiting on a worker, removed on disconnect.
+	triggerQueue chan triggerJob
+	queueMu      sync.RWMutex
+	// Timing clock messages received since the last start, and when the last beat was.
+	clockTicks uint64
+	clockBeat  time.Time
+	// Connection state of the input and output ports.
+	inState  atomic.Int32
+	outState atomic.Int32
+	// If a warning was logged that the output device is not connected.
+	outWarned atomic.Bool
+	// If a warning was logged that messages from the output device are not forwarded.
+	feedbackWarned atomic.Bool
+	// If the output driver rejected messages sent with running status.
+	runningStatusUnsupported atomic.Bool
+	// Queue of messages waiting to be sent to the firehose webhook.
+	webhookQueue chan FirehoseMessage
+	// When each trigger last fired for a channel and note, for debouncing.
+	lastFired   map[debounceKey]time.Time
+	lastFiredMu sync.Mutex
+	// Latest messages waiting for coalesced triggers to settle.
+	coalesced   map[coalesceKey]*coalescedMessage
+	coalescedMu sync.Mutex
+	// When each message type was last received, for the minimum interval.
+	lastReceived   map[MessageType]time.Time
+	lastReceivedMu sync.Mutex
+	// Closed to stop publishing the status on an interval.
+	statusStop chan struct{}
+	// Closed on disconnect to stop connecting to devices and checking they are present.
+	stop chan struct{}
+	// Goroutines connecting to devices and checking they are present, which disconnects wait on.
+	connecting sync.WaitGroup
+	// Names of the input devices being listened to.
+	inPortNames []string
+	// Subscribers streaming the MIDI messages received.
+	subscribers   map[chan FirehoseMessage]struct{}
+	subscribersMu sync.Mutex
+}
+
+// Trigger, channel, and note which are debounced together.
+type debounceKey struct {
+	trig    *NoteTrigger
+	channel uint8
+	note    uint8
+}
+
+// Trigger, channel, note, and controller of messages which are coalesced together.
+type coalesceKey struct {
+	trig       *NoteTrigger
+	channel    uint8
+	note       uint8
+	controller uint8
+}
+
+// The latest message of a coalesced trigger, and the timer which queues it.
+type coalescedMessage struct {
+	msg   MQTTPayload
+	timer *time.Timer
+	// If the message was queued, by the timer or a disconnect.
+	sent bool
+}
+
+// A note trigger queued to run for a MIDI message.
+type triggerJob struct {
+	trig *NoteTrigger
+	msg  MQTTPayload
+}
+
+// Size of the note trigger queue before the listener waits on workers.
+const triggerQueueSize = 1000
+
+// Number of note trigger workers, unless configured.
+const defaultMaxConcurrentTriggers = 8
+
+// Settings which require a separate HTTP client.
+type httpClientKey struct {
+	InsecureSkipVerify bool
+	Timeout            time.Duration
 }
 
 // Logging function to allow log levels.
 func (r *MidiRouter) Log(level LogLevel, format string, args ...interface{}) {
-	if level <= r.LogLevel {
-		log.Println(fmt.Sprintf(format, args...))
-	}
+	r.LogWithFields(level, nil, format, args...)
 }
 
-// When a MIDI message occurs, send the HTTP request.
-func (r *MidiRouter) sendRequest(channel, note, velocity uint8) {
-	// If MQTT firehose not disabled, send to general cmd topic.
-	if r.MqttClient != nil && !r.MQTT.DisableMidiFirehose {
-		payload := MQTTPayload{
-			Channel:  channel,
-			Note:     note,
-			Velocity: velocity,
-		}
-		data, err := json.Marshal(payload)
-		if err != nil {
-			r.Log(ErrorLog, "Json Encode: %s", err)
-		} else {
-			topic := r.MQTT.Topic + "/cmd"
-			r.MqttClient.Publish(topic, 0, true, data)
-			r.Log(SendLog, "-> [MQTT] %s: %s", topic, string(data))
-		}
+// Logging function which adds structured fields, such as the MIDI info or MQTT topic.
+func (r *MidiRouter) LogWithFields(level LogLevel, fields log.Fields, format string, args ...interface{}) {
+	if level > r.LogLevel {
+		return
 	}
+	r.logEntry(level, fields, format, args...)
+}
 
-	// Check each trigger to find requests that match this message.
-	for _, trig := range r.NoteTriggers {
-		// If match all notes, process this request.
-		// If not, check if channel, note, and velocity matches.
-		// The velocity may be defined to accept all.
-		if (trig.Channel == channel || trig.MatchAllChannels) && (trig.Note == note || trig.MatchAllNotes) && (trig.Velocity == velocity || trig.MatchAllVelocities) {
-			// For all logging, we want to print the message so setup a common string to print.
-			logInfo := fmt.Sprintf("note %s(%d) on channel %v with velocity %v", midi.Note(note), note, channel, velocity)
-
-			// Delay before.
-			time.Sleep(trig.DelayBefore)
-
-			// If MQTT trigger, send the MQTT request.
-			if trig.MqttTopic != "" && r.MqttClient != nil {
-				// If payload provided, send the defined payload.
-				if trig.MqttPayload != nil {
-					data, err := json.Marshal(trig.MqttPayload)
-					if err != nil {
-						r.Log(ErrorLog, "Json Encode: %s", err)
-					} else {
-						r.MqttClient.Publish(trig.MqttTopic, 0, true, data)
-						r.Log(SendLog, "-> [MQTT] %s: %s", trig.MqttTopic, string(data))
-					}
-				} else {
-					// If no payload provided, send the note information as JSON.
-					payload := MQTTPayload{
-						Channel:  channel,
-						Note:     note,
-						Velocity: velocity,
-					}
-					data, err := json.Marshal(payload)
-					if err != nil {
-						r.Log(ErrorLog, "Json Encode: %s", err)
-					} else {
-						r.MqttClient.Publish(trig.MqttTopic, 0, true, data)
-						r.Log(SendLog, "-> [MQTT] %s: %s", trig.MqttTopic, string(data))
-					}
-				}
-			}
+// Get the log level of a trigger, which overrides the router log level if set.
+func (r *MidiRouter) triggerLogLevel(override *LogLevel) LogLevel {
+	if override != nil {
+		return *override
+	}
+	return r.LogLevel
+}
 
-			// If URL trigger defined, perform a HTTP request.
-			if trig.URL != "" {
-				// Default method to GET if nothing is defined.
-				if trig.Method == "" {
-					trig.Method = "GET"
-				}
+// Logging function for messages of a trigger, using the trigger log level if set.
+func (r *MidiRouter) LogTrigger(override *LogLevel, level LogLevel, fields log.Fields, format string, args ...interface{}) {
+	if level > r.triggerLogLevel(override) {
+		return
+	}
+	r.logEntry(level, fields, format, args...)
+}
 
-				// Parse the URL to make sure its valid.
-				url, err := url.Parse(trig.URL)
-				// If not valid, we need to stop processing this request.
-				if err != nil {
-					r.Log(ErrorLog, "Trigger failed to parse url: %s\n %s", err, logInfo)
-					continue
-				}
+// Log a message with the router fields, regardless of the log level.
+func (r *MidiRouter) logEntry(level LogLevel, fields log.Fields, format string, args ...interface{}) {
+	entry := log.WithFields(log.Fields{
+		"router": r.Name,
+		"device": r.Device,
+	})
+	if fields != nil {
+		entry = entry.WithFields(fields)
+	}
+	entry.Log(level.Level(), fmt.Sprintf(format, args...))
+}
 
-				// If MIDI info needs to be added to the request, add it.
-				if trig.MidiInfoInRequest {
-					query := url.Query()
-					query.Add("channel", strconv.Itoa(int(channel)))
-					query.Add("note", strconv.Itoa(int(note)))
-					query.Add("velocity", strconv.Itoa(int(velocity)))
-					url.RawQuery = query.Encode()
-				}
+// Error returned when sending before the output device is connected.
+var errMidiOutNotConnected = errors.New("MIDI output not connected")
 
-				// If body provided, setup a reader for it.
-				var body io.Reader
-				if trig.Body != "" {
-					body = strings.NewReader(trig.Body)
-				}
+// Error returned when a request is received while the router disconnects.
+var errDisconnecting = errors.New("router is disconnecting")
 
-				// If debugging, log that we're starting a request.
-				r.Log(DebugLog, "Starting request for trigger: %s %s\n%s", trig.Method, url.String(), logInfo)
+// Send a MIDI message to the output device.
+func (r *MidiRouter) sendMidi(msg midi.Message) error {
+	if r.DryRun {
+		r.Log(InfoLog, "[DRY RUN] Would send midi message: %s", msg)
+		return nil
+	}
+	out := r.midiOut()
+	if out == nil {
+		return errMidiOutNotConnected
+	}
 
-				// Make the request.
-				req, err := http.NewRequest(trig.Method, url.String(), body)
-				if err != nil {
-					r.Log(ErrorLog, "Trigger failed to parse url: %s\n %s", err, logInfo)
-					continue
-				}
+	return out.Send(msg)
+}
 
-				// Add headers to the request.
-				req.Header = trig.Headers
+// Get the output device, or nil if not connected.
+func (r *MidiRouter) midiOut() MidiOutPort {
+	r.portsMu.RLock()
+	defer r.portsMu.RUnlock()
+	return r.MidiOut
+}
 
-				// Configure transport with trigger config.
-				tr := &http.Transport{
-					TLSClientConfig: &tls.Config{InsecureSkipVerify: trig.InsecureSkipVerify},
-				}
-				client := &http.Client{Transport: tr}
+// Get the MQTT client, or nil if MQTT was not connected.
+func (r *MidiRouter) mqttClient() mqtt.Client {
+	r.portsMu.RLock()
+	defer r.portsMu.RUnlock()
+	return r.MqttClient
+}
 
-				// Perform the request.
-				res, err := client.Do(req)
-				if err != nil {
-					r.Log(ErrorLog, "Trigger failed to request: %s\n %s", err, logInfo)
-					continue
-				}
+// Check if connected to the MQTT broker.
+func (r *MidiRouter) mqttConnected() bool {
+	client := r.mqttClient()
+	return client != nil && client.IsConnectionOpen()
+}
 
-				// Close the body at end of request.
-				defer res.Body.Close()
+// Check if listening to any input devices.
+func (r *MidiRouter) listening() bool {
+	r.portsMu.RLock()
+	defer r.portsMu.RUnlock()
+	return len(r.ListenerStops) != 0
+}
 
-				// If debug enabled, read the body and log it.
-				if r.LogLevel >= DebugLog {
-					body, err := io.ReadAll(res.Body)
-					if err != nil {
-						r.Log(ErrorLog, "Trigger failed to read body: %s\n %s", err, logInfo)
-						continue
-					}
-					r.Log(DebugLog, "Trigger response: %s\n%s", logInfo, string(body))
-				}
-			}
+// Stop listening to the input devices.
+func (r *MidiRouter) stopListening() {
+	r.portsMu.Lock()
+	stops := r.ListenerStops
+	r.ListenerStops = nil
+	r.inPortNames = nil
+	r.portsMu.Unlock()
+	for _, stop := range stops {
+		stop()
+	}
+}
 
-			// Delay after.
-			time.Sleep(trig.DelayAfter)
+// Log a failure to send a MIDI message, warning only once while the output device is not connected.
+func (r *MidiRouter) logSendError(fields log.Fields, err error) {
+	if errors.Is(err, errMidiOutNotConnected) {
+		if !r.outWarned.Swap(true) {
+			r.LogWithFields(ErrorLog, fields, "Unable to send midi messages until the output device '%s' is connected", r.Device)
 		}
+		return
 	}
+	r.LogWithFields(ErrorLog, fields, "Failed to send midi message: %s", err)
 }
 
-// Handler for HTTP requests.
-func (m *MidiRouter) Handler(w http.ResponseWriter, r *http.Request) {
-	// Check each request trigger for ones that match the request URI.
-	for _, t := range m.RequestTriggers {
-		// If matches request, process MIDI message.
-		if t.URI != "" && t.URI == r.URL.RawPath {
-			// Set default values to those from this trigger.
-			channel, note, velocity := t.Channel, t.Note, t.Velocity
-			// If MIDI info is in the request query, update to request.
-			if t.MidiInfoInRequest {
-				query := r.URL.Query()
-				// Regex to ensure only numbers are processed.
-				numRx := regexp.MustCompile(`^[0-9]+$`)
-
-				// Check for channel, and only configure if request has a valid value.
-				ch := query.Get("channel")
-				if numRx.MatchString(ch) {
-					i, err := strconv.Atoi(ch)
-					if err != nil && i <= 255 && i >= 0 {
-						channel = uint8(i)
-					}
-				}
-				// Check for note, and only configure if request has a valid value.
-				key := query.Get("note")
-				if numRx.MatchString(key) {
-					i, err := strconv.Atoi(key)
-					if err != nil && i < 255 && i >= 0 {
-						note = uint8(i)
-					}
-				}
-				// Check for velocity, and only configure if request has a valid value.
-				vel := query.Get("velocity")
-				if numRx.MatchString(vel) {
-					i, err := strconv.Atoi(vel)
-					if err != nil && i < 128 && i >= 0 {
-						velocity = uint8(i)
+// Get a shared HTTP client for the trigger's client settings, allowing connections to be reused.
+func (r *MidiRouter) httpClient(key httpClientKey) *http.Client {
+	r.httpClientsMu.Lock()
+	defer r.httpClientsMu.Unlock()
+
+	// Make the client cache if not already made.
+	if r.httpClients == nil {
+		r.httpClients = make(map[httpClientKey]*http.Client)
+	}
+
+	// If a client was already made for these settings, reuse it.
+	if client, ok := r.httpClients[key]; ok {
+		return client
+	}
+
+	// Configure transport with the client settings.
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: key.InsecureSkipVerify}
+	client := &http.Client{
+		Transport: tr,
+		Timeout:   key.Timeout,
+	}
+	r.httpClients[key] = client
+	return client
+}
+
+// Publish an MQTT message, counting it in metrics.
+func (r *MidiRouter) mqttPublish(topic string, qos byte, retain bool, payload interface{}) mqtt.Token {
+	if r.DryRun {
+		r.LogWithFields(InfoLog, log.Fields{"topic": topic}, "[DRY RUN] Would publish to %s: %s", topic, payload)
+		return dryRunToken{}
+	}
+	mqttPublishesTotal.WithLabelValues(r.Name, topic).Inc()
+	return r.mqttClient().Publish(topic, qos, retain, payload)
+}
+
+// How long to wait for the broker to acknowledge a publish.
+const publishTimeout = 10 * time.Second
+
+// Wait for a publish to complete, returning its error.
+func waitToken(t mqtt.Token) error {
+	if !t.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("publish timed out after %s", publishTimeout)
+	}
+	return t.Error()
+}
+
+// Record the result of a part of a trigger, such as the MQTT publish or HTTP request.
+func (r *MidiRouter) recordResult(leg string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	triggerResultsTotal.WithLabelValues(r.Name, leg, result).Inc()
+}
+
+// Token of a publish skipped in dry run mode, which is always complete.
+type dryRunToken struct{}
+
+func (dryRunToken) Wait() bool                     { return true }
+func (dryRunToken) WaitTimeout(time.Duration) bool { return true }
+func (dryRunToken) Error() error                   { return nil }
+func (dryRunToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// When a MIDI message occurs, queue the triggers which match it.
+func (r *MidiRouter) sendRequest(msg MQTTPayload) {
+	if !r.beginWork() {
+		return
+	}
+	defer r.inFlight.Done()
+
+	// If MQTT firehose not disabled, send to general cmd topic.
+	if r.mqttClient() != nil && !r.MQTT.DisableMidiFirehose {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			r.Log(ErrorLog, "Json Encode: %s", err)
+			r.recordResult("firehose", err)
+		} else {
+			topic := r.MQTT.Topic + "/cmd"
+			t := r.mqttPublish(topic, r.MQTT.QoS, r.MQTT.Retain, data)
+			r.LogWithFields(SendLog, log.Fields{"topic": topic}, "-> [MQTT] %s: %s", topic, string(data))
+
+			// Record the result without blocking the listener.
+			go func() {
+				err := waitToken(t)
+				if err != nil {
+					r.LogWithFields(ErrorLog, log.Fields{"topic": topic}, "Failed to publish to %s: %s", topic, err)
+				}
+				r.recordResult("firehose", err)
+			}()
+		}
+	}
+
+	// Publish notes to their mapped topics.
+	r.publishNoteTopics(msg)
+
+	// If a firehose webhook is configured, queue the message for it.
+	r.queueFirehoseWebhook(msg)
+
+	// Send the message to any streams subscribed.
+	r.publishSubscribers(msg)
+
+	// Queue each trigger which matches this message.
+	for i := range r.NoteTriggers {
+		trig := &r.NoteTriggers[i]
+		if trig.Matches(msg) && r.matchesSource(trig, msg) && r.active(trig, msg) && !r.debounced(trig, msg) {
+			triggersTotal.WithLabelValues(r.Name, "note").Inc()
+			if trig.ForwardToOutput {
+				r.forwardToOutput(trig, msg)
+			}
+			if trig.Coalesce > 0 {
+				r.coalesce(trig, msg)
+				continue
+			}
+			r.inFlight.Add(1)
+			r.queueTrigger(triggerJob{trig: trig, msg: msg})
+		}
+	}
+}
+
+// Publish a note message to the topic of each note topic map entry matching its channel and note.
+func (r *MidiRouter) publishNoteTopics(msg MQTTPayload) {
+	if r.mqttClient() == nil || len(r.NoteTopicMap) == 0 || msg.Type.OrDefault() != NoteMessage {
+		return
+	}
+
+	var data []byte
+	for _, entry := range r.NoteTopicMap {
+		if uint8(entry.Note) != msg.Note || (entry.Channel != nil && *entry.Channel != msg.Channel) {
+			continue
+		}
+		if data == nil {
+			var err error
+			data, err = json.Marshal(msg)
+			if err != nil {
+				r.Log(ErrorLog, "Json Encode: %s", err)
+				return
+			}
+		}
+
+		topic := entry.Topic
+		t := r.mqttPublish(topic, r.MQTT.QoS, r.MQTT.Retain, data)
+		r.LogWithFields(SendLog, log.Fields{"topic": topic}, "-> [MQTT] %s: %s", topic, string(data))
+
+		// Record the result without blocking the listener.
+		go func() {
+			err := waitToken(t)
+			if err != nil {
+				r.LogWithFields(ErrorLog, log.Fields{"topic": topic}, "Failed to publish to %s: %s", topic, err)
+			}
+			r.recordResult("note_topic", err)
+		}()
+	}
+}
+
+// Check if the router sends to the output device, for request triggers or forwarding.
+func (r *MidiRouter) NeedsOutput() bool {
+	if len(r.RequestTriggers) != 0 {
+		return true
+	}
+	for _, trig := range r.NoteTriggers {
+		if trig.ForwardToOutput {
+			return true
+		}
+	}
+	return false
+}
+
+// Forward a message matched by a trigger to the output device, remapping the channel and note if set.
+// Messages received from the output device are not forwarded, as they would loop back.
+func (r *MidiRouter) forwardToOutput(trig *NoteTrigger, msg MQTTPayload) {
+	out := r.midiOut()
+	if out != nil && !r.VirtualPort && msg.Source == out.String() {
+		if !r.feedbackWarned.Swap(true) {
+			r.Log(ErrorLog, "Not forwarding messages from '%s' to itself, which would cause a feedback loop", msg.Source)
+		}
+		return
+	}
+
+	if trig.OutputChannel != nil && msg.Type != SysExMessage {
+		msg.Channel = *trig.OutputChannel
+	}
+	if trig.OutputNote != nil {
+		switch msg.Type.OrDefault() {
+		case NoteMessage, PolyAfterTouchMessage:
+			msg.Note = uint8(*trig.OutputNote)
+		}
+	}
+
+	// Send MIDI message.
+	err := r.sendMidi(msg.MidiMessage())
+	if err != nil {
+		r.logSendError(msg.Fields(), err)
+		return
+	}
+	r.LogTrigger(trig.LogLevel, SendLog, msg.Fields(), "-> [MIDI] %s", msg)
+}
+
+// Check if the trigger is active at the current time of day, logging matches skipped outside its active hours.
+func (r *MidiRouter) active(trig *NoteTrigger, msg MQTTPayload) bool {
+	if len(trig.ActiveHours) == 0 {
+		return true
+	}
+	now := time.Now()
+	for _, hours := range trig.ActiveHours {
+		if hours.Contains(now) {
+			return true
+		}
+	}
+	r.LogWithFields(DebugLog, msg.Fields(), "Trigger outside active hours %v: %s", trig.ActiveHours, msg)
+	return false
+}
+
+// Get the delay before the request, with a random jitter added if set.
+func (t *NoteTrigger) delayBefore() time.Duration {
+	if t.DelayJitter <= 0 {
+		return t.DelayBefore
+	}
+	return t.DelayBefore + mrand.N(t.DelayJitter)
+}
+
+// Check if the message is from the source device of the trigger, when listening to all matching devices.
+func (r *MidiRouter) matchesSource(trig *NoteTrigger, msg MQTTPayload) bool {
+	if !r.ListenAllMatchingDevices || trig.sourceDeviceRx == nil {
+		return true
+	}
+	return trig.sourceDeviceRx.MatchString(msg.Source)
+}
+
+// Check if a trigger fired for the same channel and note within its debounce duration, recording when it fires.
+func (r *MidiRouter) debounced(trig *NoteTrigger, msg MQTTPayload) bool {
+	if trig.Debounce <= 0 {
+		return false
+	}
+	r.lastFiredMu.Lock()
+	defer r.lastFiredMu.Unlock()
+
+	// Make the map if not already made.
+	if r.lastFired == nil {
+		r.lastFired = make(map[debounceKey]time.Time)
+	}
+
+	key := debounceKey{trig: trig, channel: msg.Channel, note: msg.Note}
+	now := time.Now()
+	if last, ok := r.lastFired[key]; ok && now.Sub(last) < trig.Debounce {
+		r.LogWithFields(DebugLog, msg.Fields(), "Debounced trigger: %s", msg)
+		return true
+	}
+	r.lastFired[key] = now
+	return false
+}
+
+// Keep the latest message matching a coalesced trigger, queueing it once no more are received within the duration.
+func (r *MidiRouter) coalesce(trig *NoteTrigger, msg MQTTPayload) {
+	r.coalescedMu.Lock()
+	defer r.coalescedMu.Unlock()
+
+	// Make the map if not already made.
+	if r.coalesced == nil {
+		r.coalesced = make(map[coalesceKey]*coalescedMessage)
+	}
+
+	// Replace the message waiting, and restart the wait.
+	key := coalesceKey{trig: trig, channel: msg.Channel, note: msg.Note, controller: msg.Controller}
+	if pending, ok := r.coalesced[key]; ok {
+		r.LogWithFields(DebugLog, msg.Fields(), "Coalesced trigger: %s", msg)
+		pending.msg = msg
+		pending.timer.Reset(trig.Coalesce)
+		return
+	}
+
+	// The message is in-flight while waiting, so disconnects send it.
+	r.inFlight.Add(1)
+	pending := &coalescedMessage{msg: msg}
+	pending.timer = time.AfterFunc(trig.Coalesce, func() {
+		r.coalescedMu.Lock()
+		// A timer reset after firing may fire again once the message was queued.
+		if pending.sent {
+			r.coalescedMu.Unlock()
+			return
+		}
+		pending.sent = true
+		delete(r.coalesced, key)
+		msg := pending.msg
+		r.coalescedMu.Unlock()
+
+		triggersTotal.WithLabelValues(r.Name, "note").Inc()
+		r.queueTrigger(triggerJob{trig: trig, msg: msg})
+	})
+	r.coalesced[key] = pending
+}
+
+// Queue the latest messages of coalesced triggers without waiting for them to settle, as when disconnecting.
+func (r *MidiRouter) flushCoalesced() {
+	r.coalescedMu.Lock()
+	var jobs []triggerJob
+	for key, pending := range r.coalesced {
+		if !pending.sent {
+			pending.sent = true
+			pending.timer.Stop()
+			jobs = append(jobs, triggerJob{trig: key.trig, msg: pending.msg})
+		}
+	}
+	r.coalesced = nil
+	r.coalescedMu.Unlock()
+
+	for _, job := range jobs {
+		triggersTotal.WithLabelValues(r.Name, "note").Inc()
+		r.queueTrigger(job)
+	}
+}
+
+// Queue a note trigger already counted in-flight for a worker to run.
+// Returns false if the router was disconnected, with the trigger no longer in-flight.
+func (r *MidiRouter) queueTrigger(job triggerJob) bool {
+	r.portsMu.RLock()
+	stop := r.stop
+	r.portsMu.RUnlock()
+
+	r.queueMu.RLock()
+	defer r.queueMu.RUnlock()
+	if r.triggerQueue == nil {
+		r.inFlight.Done()
+		return false
+	}
+	select {
+	case r.triggerQueue <- job:
+		return true
+	default:
+	}
+
+	// Wait for a worker while the queue is full, unless disconnecting, which clears the stop channel,
+	// so workers stuck on slow requests do not hold up the disconnect closing the queue.
+	if stop != nil {
+		select {
+		case r.triggerQueue <- job:
+			return true
+		case <-stop:
+		}
+	}
+	r.LogWithFields(ErrorLog, job.msg.Fields(), "Dropped trigger queued while disconnecting: %s", job.msg)
+	r.inFlight.Done()
+	return false
+}
+
+// Process queued triggers, each in order of delay before, requests, then delay after.
+func (r *MidiRouter) triggerWorker(queue chan triggerJob) {
+	for job := range queue {
+		r.runTrigger(job.trig, job.msg)
+		r.inFlight.Done()
+	}
+}
+
+// Error of a request which responded with an unsuccessful status.
+type statusError struct {
+	method string
+	url    string
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %s responded with %s", e.method, e.url, e.status)
+}
+
+// Perform the HTTP request of a trigger, returning if a failure should be retried.
+func (r *MidiRouter) sendHTTPRequest(trig *NoteTrigger, method, url, reqBody string, fields log.Fields) (bool, error) {
+	// If body provided, setup a reader for it.
+	var body io.Reader
+	if reqBody != "" {
+		body = strings.NewReader(reqBody)
+	}
+
+	// If debugging, log that we're starting a request.
+	r.LogTrigger(trig.LogLevel, DebugLog, fields, "Starting request for trigger: %s %s", method, url)
+
+	// Make the request.
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return false, err
+	}
+
+	// Add headers to the request.
+	req.Header = trig.RequestHeader(reqBody)
+	if trig.BasicAuthUser != "" || trig.BasicAuthPassword != "" {
+		req.SetBasicAuth(trig.BasicAuthUser, trig.BasicAuthPassword)
+	}
+	if trig.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+trig.BearerToken)
+	}
+
+	// In dry run mode, log the request instead of sending it.
+	if r.DryRun {
+		r.LogTrigger(trig.LogLevel, InfoLog, fields, "[DRY RUN] Would request %s %s: %s", method, url, reqBody)
+		return false, nil
+	}
+
+	// Perform the request with the shared client.
+	client := r.httpClient(httpClientKey{
+		InsecureSkipVerify: trig.InsecureSkipVerify,
+		Timeout:            trig.Timeout,
+	})
+	start := time.Now()
+	res, err := client.Do(req)
+	httpRequestDuration.WithLabelValues(r.Name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		httpRequestsTotal.WithLabelValues(r.Name, "error").Inc()
+		return true, err
+	}
+	httpRequestsTotal.WithLabelValues(r.Name, strconv.Itoa(res.StatusCode)).Inc()
+
+	// If debug enabled or the response is published, read the body, limiting the size published.
+	forward := trig.ResponseToMqttTopic != "" && r.mqttClient() != nil
+	var resBody []byte
+	if forward || r.triggerLogLevel(trig.LogLevel) >= DebugLog {
+		resBody, err = io.ReadAll(io.LimitReader(res.Body, maxResponseSize+1))
+		if err != nil {
+			r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger failed to read body: %s", err)
+			forward = false
+		} else {
+			r.LogTrigger(trig.LogLevel, DebugLog, fields, "Trigger response: %s", string(resBody))
+		}
+		if len(resBody) > maxResponseSize {
+			if forward {
+				r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger response is larger than %d bytes, not publishing it", maxResponseSize)
+			}
+			forward = false
+		}
+	}
+	// Drain and close the body so the connection can be reused.
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	// Server errors may be temporary, so they should be retried.
+	if res.StatusCode >= 500 {
+		return true, &statusError{method: method, url: url, status: res.Status}
+	}
+	// Other unsuccessful responses fail without retrying.
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return false, &statusError{method: method, url: url, status: res.Status}
+	}
+
+	// Publish the response of a successful request if configured.
+	if forward {
+		r.publishResponse(trig, resBody)
+	}
+	return false, nil
+}
+
+// Get the router publish settings, unless overridden by the trigger.
+func (r *MidiRouter) publishSettings(trig *NoteTrigger) (byte, bool) {
+	qos, retain := r.MQTT.QoS, r.MQTT.Retain
+	if trig.MqttQoS != nil {
+		qos = *trig.MqttQoS
+	}
+	if trig.MqttRetain != nil {
+		retain = *trig.MqttRetain
+	}
+	return qos, retain
+}
+
+// Publish the body of a successful HTTP response of a trigger.
+func (r *MidiRouter) publishResponse(trig *NoteTrigger, body []byte) {
+	topic := trig.ResponseToMqttTopic
+	qos, retain := r.publishSettings(trig)
+	t := r.mqttPublish(topic, qos, retain, body)
+	err := waitToken(t)
+	if err != nil {
+		r.LogTrigger(trig.LogLevel, ErrorLog, log.Fields{"topic": topic}, "Trigger failed to publish response to %s: %s", topic, err)
+	} else {
+		r.LogTrigger(trig.LogLevel, SendLog, log.Fields{"topic": topic}, "-> [MQTT] %s: %s", topic, string(body))
+	}
+	r.recordResult("response", err)
+}
+
+// Publish the MQTT message of a trigger.
+func (r *MidiRouter) publishTrigger(trig *NoteTrigger, msg MQTTPayload, fields log.Fields) error {
+	data := NewTemplateData(msg)
+
+	// Render the topic, which must not be empty.
+	topic, err := renderTemplate(trig.topicTemplate, trig.MqttTopic, data)
+	if err != nil {
+		r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger failed to render mqtt topic: %s", err)
+		return err
+	}
+	if strings.TrimSpace(topic) == "" {
+		r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger mqtt topic rendered empty: %s", trig.MqttTopic)
+		return fmt.Errorf("topic rendered empty: %s", trig.MqttTopic)
+	}
+
+	qos, retain := r.publishSettings(trig)
+
+	// If payload provided, send the defined payload.
+	var payload []byte
+	if trig.MqttPayload != nil {
+		// Render templates within the payload.
+		rendered, err := renderPayload(trig.MqttPayload, trig.payloadTemplates, data)
+		if err != nil {
+			r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger failed to render mqtt payload: %s", err)
+			return err
+		}
+		// String payloads with templates are sent as is.
+		if text, ok := trig.MqttPayload.(string); ok && trig.payloadTemplates[text] != nil {
+			payload = []byte(rendered.(string))
+		} else {
+			payload, err = json.Marshal(rendered)
+		}
+		if err != nil {
+			r.LogTrigger(trig.LogLevel, ErrorLog, nil, "Json Encode: %s", err)
+			return err
+		}
+	} else {
+		// If no payload provided, send the message information as JSON.
+		payload, err = json.Marshal(msg)
+		if err != nil {
+			r.LogTrigger(trig.LogLevel, ErrorLog, nil, "Json Encode: %s", err)
+			return err
+		}
+	}
+	t := r.mqttPublish(topic, qos, retain, payload)
+	err = waitToken(t)
+	if err != nil {
+		r.LogTrigger(trig.LogLevel, ErrorLog, log.Fields{"topic": topic}, "Trigger failed to publish to %s: %s", topic, err)
+		return err
+	}
+	r.LogTrigger(trig.LogLevel, SendLog, log.Fields{"topic": topic}, "-> [MQTT] %s: %s", topic, string(payload))
+	return nil
+}
+
+// Send the MQTT and HTTP requests of a trigger for a MIDI message.
+func (r *MidiRouter) runTrigger(trig *NoteTrigger, msg MQTTPayload) {
+	// For all logging, we want to include the message so setup common fields to log.
+	fields := msg.Fields()
+
+	// Scale the velocity of note on messages, leaving note off messages as is.
+	if msg.IsNoteOn() {
+		msg.Velocity = trig.VelocityScale.Scale(msg.Velocity)
+	}
+
+	// Remap the channel, if set.
+	if trig.OutputChannel != nil && msg.Type != SysExMessage {
+		msg.Channel = *trig.OutputChannel
+	}
+
+	// Delay before.
+	time.Sleep(trig.delayBefore())
+
+	// Send each of the MQTT and HTTP requests, recording the result of each independently.
+	var errs []error
+	if trig.MqttTopic != "" && r.mqttClient() != nil {
+		err := r.publishTrigger(trig, msg, fields)
+		r.recordResult("mqtt", err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("mqtt: %w", err))
+		}
+	}
+	if trig.OscAddress != "" && r.oscClient != nil {
+		err := r.sendTriggerOSC(trig, msg, fields)
+		r.recordResult("osc", err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("osc: %w", err))
+		}
+	}
+	if trig.URL != "" {
+		err := r.sendTriggerHTTP(trig, msg, fields)
+		r.recordResult("http", err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("http: %w", err))
+		}
+	}
+	if trig.RequireAllSucceed && len(errs) != 0 {
+		r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger did not fully succeed: %s", errors.Join(errs...))
+	}
+
+	// Delay after.
+	time.Sleep(trig.DelayAfter)
+}
+
+// Send the HTTP request of a trigger for a MIDI message, retrying on failure.
+func (r *MidiRouter) sendTriggerHTTP(trig *NoteTrigger, msg MQTTPayload, fields log.Fields) error {
+	// Default method to GET if nothing is defined.
+	method := trig.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	// Render the URL and body templates with the MIDI info.
+	data := NewTemplateData(msg)
+	rawURL, err := renderTemplate(trig.urlTemplate, trig.URL, data)
+	if err != nil {
+		r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger failed to render url: %s", err)
+		return err
+	}
+	reqBody, err := renderTemplate(trig.bodyTemplate, trig.Body, data)
+	if err != nil {
+		r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger failed to render body: %s", err)
+		return err
+	}
+	// Without a body, system exclusive bytes are sent as base64.
+	if reqBody == "" && msg.Type == SysExMessage {
+		reqBody = base64.StdEncoding.EncodeToString(msg.SysEx)
+	}
+
+	// Parse the URL to make sure its valid.
+	url, err := url.Parse(rawURL)
+	// If not valid, we need to stop processing this request.
+	if err != nil {
+		r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger failed to parse url: %s", err)
+		return err
+	}
+
+	// If MIDI info needs to be added to the request, add it.
+	if trig.MidiInfoInRequest {
+		query := url.Query()
+		query.Add("channel", strconv.Itoa(int(msg.displayChannel())))
+		switch msg.Type {
+		case ProgramChangeMessage:
+			query.Add("program", strconv.Itoa(int(msg.Program)))
+		case ControlChangeMessage:
+			query.Add("controller", strconv.Itoa(int(msg.Controller)))
+			query.Add("value", strconv.Itoa(int(msg.Value)))
+		case PitchBendMessage:
+			query.Add("bend", strconv.Itoa(int(msg.Bend)))
+		case AfterTouchMessage:
+			query.Add("pressure", strconv.Itoa(int(msg.Pressure)))
+		case PolyAfterTouchMessage:
+			query.Add("note", strconv.Itoa(int(msg.Note)))
+			query.Add("pressure", strconv.Itoa(int(msg.Pressure)))
+		case SysExMessage:
+			query.Add("sysex", base64.StdEncoding.EncodeToString(msg.SysEx))
+		default:
+			query.Add("note", strconv.Itoa(int(msg.Note)))
+			query.Add("velocity", strconv.Itoa(int(msg.Velocity)))
+		}
+		query.Add("timestamp", strconv.Itoa(int(msg.Timestamp)))
+		url.RawQuery = query.Encode()
+	}
+
+	// Perform the request, retrying with exponential backoff on failure.
+	backoff := trig.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := r.sendHTTPRequest(trig, method, url.String(), reqBody, fields)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= trig.Retries {
+			// Unsuccessful statuses are logged at any log level, as the endpoint may otherwise fail unnoticed.
+			var statusErr *statusError
+			if errors.As(err, &statusErr) {
+				r.logEntry(ErrorLog, fields, "Trigger failed to request: %s", err)
+			} else {
+				r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger failed to request: %s", err)
+			}
+			return err
+		}
+		r.LogTrigger(trig.LogLevel, DebugLog, fields, "Trigger request attempt %d failed, retrying in %s: %s", attempt+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Send a note off after the duration, tracking it as in-flight until sent.
+func (r *MidiRouter) scheduleNoteOff(channel, note uint8, duration time.Duration) {
+	r.inFlight.Add(1)
+	time.AfterFunc(duration, func() {
+		defer r.inFlight.Done()
+
+		// Send MIDI message.
+		err := r.sendMidi(midi.NoteOff(channel, note))
+		if err != nil {
+			r.logSendError(nil, err)
+		}
+	})
+}
+
+// Send the messages of a sequence in order, waiting the delay of each,
+// and returning the last message sent.
+func (r *MidiRouter) sendSequence(t *RequestTrigger) (MQTTPayload, error) {
+	seq := t.Sequence
+	payloads := make([]MQTTPayload, len(seq))
+	for i := range seq {
+		payloads[i] = seq[i].Payload()
+		payloads[i].channelBase = r.ChannelDisplayBase
+		t.remapChannel(&payloads[i])
+	}
+
+	var payload MQTTPayload
+	for i := 0; i < len(seq); {
+		if seq[i].Delay > 0 {
+			time.Sleep(seq[i].Delay)
+		}
+
+		// With running status, send the following messages of the same status without a delay together.
+		msgs := []MQTTPayload{payloads[i]}
+		if r.RunningStatus && !r.runningStatusUnsupported.Load() {
+			status := runningStatus(msgs[0].MidiMessage())
+			for status != 0 && i+len(msgs) < len(seq) {
+				next := i + len(msgs)
+				if seq[next].Delay > 0 || runningStatus(payloads[next].MidiMessage()) != status {
+					break
+				}
+				msgs = append(msgs, payloads[next])
+			}
+		}
+		i += len(msgs)
+
+		err := r.sendMessages(msgs)
+		if err != nil {
+			return msgs[0], err
+		}
+		for _, msg := range msgs {
+			r.LogTrigger(t.LogLevel, SendLog, msg.Fields(), "-> [MIDI] %s", msg)
+		}
+		payload = msgs[len(msgs)-1]
+	}
+	return payload, nil
+}
+
+// Get the status byte of a channel message, which may be omitted from following messages
+// with the same status, or 0 for other messages.
+func runningStatus(msg midi.Message) byte {
+	if len(msg) > 1 && msg[0] >= 0x80 && msg[0] < 0xF0 {
+		return msg[0]
+	}
+	return 0
+}
+
+// Send messages, combining messages of the same status with running status,
+// and sending them separately if the driver rejects the combined messages.
+func (r *MidiRouter) sendMessages(msgs []MQTTPayload) error {
+	if len(msgs) > 1 {
+		data := append([]byte(nil), msgs[0].MidiMessage()...)
+		for _, msg := range msgs[1:] {
+			data = append(data, msg.MidiMessage()[1:]...)
+		}
+		err := r.sendMidi(midi.Message(data))
+		if err == nil || errors.Is(err, errMidiOutNotConnected) {
+			return err
+		}
+		r.Log(ErrorLog, "Output driver does not support running status, sending messages separately: %s", err)
+		r.runningStatusUnsupported.Store(true)
+	}
+	for _, msg := range msgs {
+		err := r.sendMidi(msg.MidiMessage())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler for HTTP requests.
+func (m *MidiRouter) Handler(w http.ResponseWriter, r *http.Request) {
+	RequestTriggersHandler([]*MidiRouter{m})(w, r)
+}
+
+// Make a handler for HTTP requests which runs the matching request triggers of each router,
+// allowing routers to share a URI.
+func RequestTriggersHandler(routers []*MidiRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// If the request has a JSON body, read it for MIDI info.
+		var body []byte
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			var err error
+			body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				log.Errorf("Failed to read request body: %s", err)
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Get the route path which matched the request.
+		path := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				path = tmpl
+			}
+		}
+
+		// Check each request trigger of each router for ones that match the request URI,
+		// responding once with the last trigger run.
+		var respond func()
+		var allowed []string
+		for _, m := range routers {
+			for i := range m.RequestTriggers {
+				t := &m.RequestTriggers[i]
+				matchedPattern := t.URIPattern != "" && t.URIPattern == path
+				if (t.URI == "" || t.URI != path) && !matchedPattern {
+					continue
+				}
+
+				// Skip triggers which do not allow the method, keeping the methods allowed for the response.
+				if !t.AllowsMethod(r.Method) {
+					for _, method := range t.AllowedMethods {
+						method = strings.ToUpper(method)
+						if !slices.Contains(allowed, method) {
+							allowed = append(allowed, method)
+						}
+					}
+					continue
+				}
+
+				// Process the MIDI message, stopping on failure.
+				payload, status, err := m.runRequestTrigger(t, r, body, matchedPattern)
+				if err != nil {
+					http.Error(w, err.Error(), status)
+					return
+				}
+
+				// If requested, respond with the message sent.
+				if t.RespondWithMidiInfo {
+					info := payload
+					respond = func() {
+						w.Header().Set("Content-Type", "application/json")
+						json.NewEncoder(w).Encode(info)
+					}
+				} else {
+					// Respond with the success status.
+					status := t.SuccessStatus
+					respond = func() {
+						w.WriteHeader(status)
 					}
 				}
 			}
+		}
+		if respond == nil && len(allowed) != 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if respond == nil {
+			http.NotFound(w, r)
+			return
+		}
+		respond()
+	}
+}
+
+// Send the MIDI message of a request trigger, returning the message sent,
+// or the HTTP status and error to respond with on failure.
+func (m *MidiRouter) runRequestTrigger(t *RequestTrigger, r *http.Request, body []byte, matchedPattern bool) (MQTTPayload, int, error) {
+	if !m.beginWork() {
+		return MQTTPayload{}, http.StatusServiceUnavailable, errDisconnecting
+	}
+	defer m.inFlight.Done()
+	fields := log.Fields{"uri": r.URL.Path}
+
+	// Without an output device, no messages can be sent.
+	if m.midiOut() == nil && !m.DryRun {
+		m.logSendError(fields, errMidiOutNotConnected)
+		return MQTTPayload{}, http.StatusServiceUnavailable, errMidiOutNotConnected
+	}
 
-			// Get send function for output.
-			send, err := midi.SendTo(m.MidiOut)
+	// Set default values to those from this trigger.
+	payload := t.Payload()
+	payload.channelBase = m.ChannelDisplayBase
+	// If MIDI info is in the request, update to request.
+	if t.MidiInfoInRequest {
+		// Parse the JSON body first, so the query takes precedence.
+		if len(body) != 0 {
+			err := json.Unmarshal(body, &payload)
 			if err != nil {
-				m.Log(ErrorLog, "Failed to get midi sender for request: %s\n%s", t.URI, err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				m.LogTrigger(t.LogLevel, ErrorLog, fields, "Json Error: %s", err)
+				return payload, http.StatusBadRequest, fmt.Errorf("invalid json body: %v", err)
+			}
+			if !payload.Type.IsValid() {
+				return payload, http.StatusBadRequest, fmt.Errorf("unsupported message type: %s", payload.Type)
+			}
+			err = payload.CheckRange()
+			if err != nil {
+				return payload, http.StatusBadRequest, err
+			}
+		}
+
+		// Update to the query values.
+		err := payload.ParseValues(r.URL.Query())
+		if err != nil {
+			return payload, http.StatusBadRequest, err
+		}
+	}
+
+	// Update to the values of URI pattern variables.
+	if matchedPattern {
+		err := payload.ParseVars(mux.Vars(r))
+		if err != nil {
+			return payload, http.StatusBadRequest, err
+		}
+	}
+
+	// Scale the velocity of note on messages back to the MIDI range.
+	if payload.IsNoteOn() {
+		payload.Velocity = t.VelocityScale.Unscale(payload.Velocity)
+	}
+	t.remapChannel(&payload)
+
+	// Send the sequence if set, otherwise the MIDI message.
+	var err error
+	if len(t.Sequence) != 0 {
+		payload, err = m.sendSequence(t)
+	} else {
+		err = m.sendMidi(payload.MidiMessage())
+		if err == nil {
+			m.LogTrigger(t.LogLevel, SendLog, payload.Fields(), "-> [MIDI] %s", payload)
+		}
+	}
+	if errors.Is(err, errMidiOutNotConnected) {
+		m.logSendError(fields, err)
+		return payload, http.StatusServiceUnavailable, err
+	} else if err != nil {
+		m.logSendError(fields, err)
+		return payload, http.StatusInternalServerError, errors.New(http.StatusText(http.StatusInternalServerError))
+	}
+
+	// If a duration is set, turn the note off after it.
+	if t.Duration != 0 && payload.IsNoteOn() && len(t.Sequence) == 0 {
+		m.scheduleNoteOff(payload.Channel, payload.Note, t.Duration)
+	}
+
+	triggersTotal.WithLabelValues(m.Name, "http").Inc()
+	return payload, 0, nil
+}
+
+// Send config to MQTT status.
+func (r *MidiRouter) SendStatus() {
+	// If disabled, ignore.
+	if r.MQTT.DisableConfigSend {
+		return
+	}
+
+	// Make JSON dump, with when it was sent and the connection state.
+	config, err := json.Marshal(struct {
+		*MidiRouter
+		Timestamp time.Time
+		State     ConnectionState
+	}{r, time.Now(), r.ConnectionState()})
+	if err != nil {
+		r.Log(ErrorLog, "Json Error: %s", err)
+		return
+	}
+
+	// Send config.
+	r.mqttPublish(r.MQTT.Topic+"/status", r.MQTT.QoS, true, config)
+}
+
+// Handle MQTT events.
+func (r *MidiRouter) MqttOnEvent(client mqtt.Client, message mqtt.Message) {
+	if !r.beginWork() {
+		return
+	}
+	defer r.inFlight.Done()
+
+	r.LogWithFields(ReceiveLog, log.Fields{"topic": message.Topic()}, "<- [MQTT] %s: %s", message.Topic(), message.Payload())
+
+	// Check commands to see if one matches this topic.
+	for _, t := range r.RequestTriggers {
+		if (t.MqttTopic != "" && message.Topic() == t.MqttTopic) ||
+			(t.MqttSubTopic != "" && message.Topic() == r.MQTT.Topic+"/"+t.MqttSubTopic) {
+			// If arguments allowed and provided, parse, otherwise use default payload.
+			arguments := t.Payload()
+			arguments.channelBase = r.ChannelDisplayBase
+			if !t.DisallowPayload && len(message.Payload()) != 0 {
+				err := json.Unmarshal(message.Payload(), &arguments)
+				if err != nil {
+					r.LogTrigger(t.LogLevel, ErrorLog, log.Fields{"topic": message.Topic()}, "Json Error: %s", err)
+					return
+				}
+				if !arguments.Type.IsValid() {
+					r.LogTrigger(t.LogLevel, ErrorLog, log.Fields{"topic": message.Topic()}, "Invalid message: unsupported message type: %s", arguments.Type)
+					return
+				}
+				err = arguments.CheckRange()
+				if err != nil {
+					r.LogTrigger(t.LogLevel, ErrorLog, log.Fields{"topic": message.Topic()}, "Invalid message: %s", err)
+					return
+				}
+			}
+
+			r.fireRequestTrigger(&t, arguments, log.Fields{"topic": message.Topic()}, "mqtt")
+		}
+	}
+
+	// If standard send topic.
+	if strings.HasPrefix(message.Topic(), r.MQTT.Topic+"/send") {
+		// If arguments allowed and provided, parse, otherwise use default payload.
+		arguments := MQTTPayload{channelBase: r.ChannelDisplayBase}
+		if len(message.Payload()) != 0 {
+			err := json.Unmarshal(message.Payload(), &arguments)
+			if err != nil {
+				r.Log(ErrorLog, "Json Error: %s", err)
+				return
+			}
+			if !arguments.Type.IsValid() {
+				r.Log(ErrorLog, "Invalid message: unsupported message type: %s", arguments.Type)
+				return
+			}
+			err = arguments.CheckRange()
+			if err != nil {
+				r.Log(ErrorLog, "Invalid message: %s", err)
 				return
 			}
+			// Send MIDI message.
+			err = r.sendMidi(arguments.MidiMessage())
+			if err != nil {
+				r.logSendError(log.Fields{"topic": message.Topic()}, err)
+				return
+			}
+		}
+	} else if r.MQTT.ForwardClock && message.Topic() == r.MQTT.Topic+"/transport/send" {
+		r.sendTransport(message.Payload())
+	} else if message.Topic() == r.MQTT.Topic+"/status/check" {
+		r.SendStatus()
+	} else if message.Topic() == r.MQTT.Topic+"/panic" {
+		err := r.sendPanic()
+		if err != nil {
+			r.logSendError(log.Fields{"topic": message.Topic()}, err)
+		}
+	}
+}
+
+// Send the MIDI message of a request trigger received from MQTT or OSC, with the arguments received.
+func (r *MidiRouter) fireRequestTrigger(t *RequestTrigger, arguments MQTTPayload, fields log.Fields, source string) {
+	// Scale the velocity of note on messages back to the MIDI range.
+	if arguments.IsNoteOn() {
+		arguments.Velocity = t.VelocityScale.Unscale(arguments.Velocity)
+	}
+	t.remapChannel(&arguments)
+
+	// Send the sequence if set, otherwise the MIDI message.
+	var err error
+	if len(t.Sequence) != 0 {
+		_, err = r.sendSequence(t)
+	} else {
+		err = r.sendMidi(arguments.MidiMessage())
+		if err == nil {
+			r.LogTrigger(t.LogLevel, SendLog, arguments.Fields(), "-> [MIDI] %s", arguments)
+		}
+	}
+	if err != nil {
+		r.logSendError(fields, err)
+		return
+	}
+
+	// If a duration is set, turn the note off after it.
+	if t.Duration != 0 && arguments.IsNoteOn() && len(t.Sequence) == 0 {
+		r.scheduleNoteOff(arguments.Channel, arguments.Note, t.Duration)
+	}
+	triggersTotal.WithLabelValues(r.Name, source).Inc()
+}
+
+// Subscribe to MQTT Topic.
+func (r *MidiRouter) MqttSubscribe(topic string) {
+	r.Log(DebugLog, "Subscribing MQTT: %s", topic)
+	if t := r.mqttClient().Subscribe(topic, r.MQTT.QoS, r.MqttOnEvent); t.Wait() && t.Error() != nil {
+		r.Log(ErrorLog, "MQTT Subscribe Error: %s", t.Error())
+	}
+}
+
+// On MQTT connect or reconnect, subscribe to topics.
+func (r *MidiRouter) MqttOnConnect(client mqtt.Client) {
+	r.Log(InfoLog, "Connected to MQTT")
+
+	// Mark available.
+	r.mqttPublish(r.MQTT.GetAvailabilityTopic(), r.MQTT.QoS, true, "online")
+
+	// Let Home Assistant discover the triggers.
+	if r.MQTT.HomeAssistantDiscovery {
+		r.SendHomeAssistantDiscovery()
+	}
+
+	// Subscribe to MQTT topics.
+	r.MqttSubscribe(r.MQTT.Topic + "/send")
+	r.MqttSubscribe(r.MQTT.Topic + "/status/check")
+	r.MqttSubscribe(r.MQTT.Topic + "/panic")
+	if r.MQTT.ForwardClock {
+		r.MqttSubscribe(r.MQTT.Topic + "/transport/send")
+	}
+	// Subscribe to command topics configured.
+	for _, trig := range r.RequestTriggers {
+		if trig.MqttTopic != "" {
+			r.MqttSubscribe(trig.MqttTopic)
+		}
+		if trig.MqttSubTopic != "" {
+			r.MqttSubscribe(r.MQTT.Topic + "/" + trig.MqttSubTopic)
+		}
+	}
+}
+
+// Drivers which are able to create virtual ports.
+type virtualPortDriver interface {
+	OpenVirtualIn(name string) (drivers.In, error)
+	OpenVirtualOut(name string) (drivers.Out, error)
+}
+
+// Get the name to use for virtual ports.
+func (r *MidiRouter) virtualPortName() string {
+	if r.VirtualPortName != "" {
+		return r.VirtualPortName
+	}
+	if r.Name != "" {
+		return r.Name
+	}
+	return serviceName
+}
+
+// Get the virtual port capable driver.
+func virtualDriver() (virtualPortDriver, error) {
+	drv, ok := drivers.Get().(virtualPortDriver)
+	if !ok {
+		return nil, fmt.Errorf("midi driver does not support virtual ports")
+	}
+	return drv, nil
+}
+
+// Find the port whose name matches the regular expression, which is the first match unless configured to use the last.
+// All matching ports are also returned, so multiple matches may be logged.
+func findPort[T interface{ String() string }](ports []T, deviceRx *regexp.Regexp, last bool) (T, []T, error) {
+	matches, err := findPorts(ports, deviceRx)
+	if err != nil {
+		var port T
+		return port, nil, err
+	}
+	if last {
+		return matches[len(matches)-1], matches, nil
+	}
+	return matches[0], matches, nil
+}
+
+// Log the ports matching the device if more than one matches, so the device can be disambiguated.
+func logMatches[T interface{ String() string }](r *MidiRouter, kind string, port T, matches []T) {
+	if len(matches) < 2 {
+		return
+	}
+	var names []string
+	for _, match := range matches {
+		names = append(names, match.String())
+	}
+	r.Log(InfoLog, "Device '%s' matches multiple %s devices, using '%s': %s", r.Device, kind, port, strings.Join(names, ", "))
+}
+
+// Compile the device regular expression, applying the exact and case insensitive options.
+func (r *MidiRouter) deviceRegexp() (*regexp.Regexp, error) {
+	expr := r.Device
+	if r.DeviceExact {
+		expr = "^(?:" + expr + ")$"
+	}
+	if r.DeviceCaseInsensitive {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+// Open the output port, either virtual or the device matching the regular expression.
+func (r *MidiRouter) openOutPort(deviceRx *regexp.Regexp) (MidiOutPort, error) {
+	if r.VirtualPort {
+		drv, err := virtualDriver()
+		if err != nil {
+			return nil, err
+		}
+		out, err := drv.OpenVirtualOut(r.virtualPortName())
+		if err != nil {
+			return nil, err
+		}
+		return driverOutPort{out}, nil
+	}
+
+	out, matches, err := findPort(listOutPorts(), deviceRx, r.UseLastMatchingDevice)
+	if err != nil {
+		return nil, err
+	}
+	logMatches(r, "output", out, matches)
+	if err := out.Open(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
 
-			// Make the MIDI message based on information.
-			msg := midi.NoteOn(channel, note, velocity)
-			if velocity == 0 {
-				msg = midi.NoteOff(channel, note)
-			}
+// Find all ports whose name matches the regular expression.
+func findPorts[T interface{ String() string }](ports []T, deviceRx *regexp.Regexp) ([]T, error) {
+	var matches []T
+	for _, p := range ports {
+		if deviceRx.MatchString(p.String()) {
+			matches = append(matches, p)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("unable to find matching device")
+	}
+	return matches, nil
+}
 
-			// Send MIDI message.
-			err = send(msg)
-			if err != nil {
-				m.Log(ErrorLog, "Failed to send midi message: %s\n%s", t.URI, err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
-			}
+// Open the input ports, either virtual or the devices matching the regular expression.
+func (r *MidiRouter) openInPorts(deviceRx *regexp.Regexp) ([]MidiInPort, error) {
+	if r.VirtualPort {
+		drv, err := virtualDriver()
+		if err != nil {
+			return nil, err
+		}
+		in, err := drv.OpenVirtualIn(r.virtualPortName())
+		if err != nil {
+			return nil, err
+		}
+		return []MidiInPort{driverInPort{in}}, nil
+	}
+
+	// Find the ports to open.
+	var ins []MidiInPort
+	if r.ListenAllMatchingDevices {
+		ports, err := findPorts(listInPorts(), deviceRx)
+		if err != nil {
+			return nil, err
+		}
+		ins = ports
+	} else {
+		in, matches, err := findPort(listInPorts(), deviceRx, r.UseLastMatchingDevice)
+		if err != nil {
+			return nil, err
+		}
+		logMatches(r, "input", in, matches)
+		ins = []MidiInPort{in}
+	}
 
-			// Update HTTP status to no content as an success message.
-			http.Error(w, http.StatusText(http.StatusNoContent), http.StatusNoContent)
+	// Open each port.
+	for _, in := range ins {
+		if err := in.Open(); err != nil {
+			return nil, err
 		}
 	}
+	return ins, nil
 }
 
-// Send config to MQTT status.
-func (r *MidiRouter) SendStatus() {
-	// If disabled, ignore.
-	if r.MQTT.DisableConfigSend {
-		return
+// Get the connection state of the MIDI ports in use, being the least connected of them.
+func (r *MidiRouter) ConnectionState() ConnectionState {
+	state := Connected
+	if !r.DisableListener {
+		state = min(state, ConnectionState(r.inState.Load()))
 	}
+	if r.NeedsOutput() {
+		state = min(state, ConnectionState(r.outState.Load()))
+	}
+	return state
+}
 
-	// Make JSON dump.
-	config, err := json.Marshal(&r)
-	if err != nil {
-		r.Log(ErrorLog, "Json Error: %s", err)
+// Check if the stop channel was closed.
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
 	}
+}
 
-	// Send config.
-	r.MqttClient.Publish(r.MQTT.Topic+"/status", 0, true, config)
+// Wait for the duration, returning false if stopped before it passed.
+func sleepUntilStopped(stop chan struct{}, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
 }
 
-// Handle MQTT events.
-func (r *MidiRouter) MqttOnEvent(client mqtt.Client, message mqtt.Message) {
-	r.Log(ReceiveLog, "<- [MQTT] %s: %s\n", message.Topic(), message.Payload())
+// Run a goroutine connecting to devices, which disconnects wait on.
+func (r *MidiRouter) goConnecting(fn func()) {
+	r.connecting.Add(1)
+	go func() {
+		defer r.connecting.Done()
+		fn()
+	}()
+}
 
-	// Check commands to see if one matches this topic.
-	for _, t := range r.RequestTriggers {
-		if (t.MqttTopic != "" && message.Topic() == t.MqttTopic) ||
-			(t.MqttSubTopic != "" && message.Topic() == r.MQTT.Topic+"/"+t.MqttSubTopic) {
-			// Set default values to those from this trigger.
-			channel, note, velocity := t.Channel, t.Note, t.Velocity
+// Retry connecting to a port with exponential backoff until successful or stopped, updating the connection state.
+// The first attempt waits for the delay, so devices may settle after startup.
+func (r *MidiRouter) connectPort(stop chan struct{}, state *atomic.Int32, delay time.Duration, connect func() error) {
+	if stopped(stop) {
+		return
+	}
+	state.Store(int32(Connecting))
+	if delay > 0 {
+		r.Log(DebugLog, "Waiting %s before connecting to devices", delay)
+		if !sleepUntilStopped(stop, delay) {
+			return
+		}
+	}
+	interval := r.ReconnectInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if stopped(stop) {
+			return
+		}
+		if err == nil {
+			state.Store(int32(Connected))
+			return
+		}
 
-			// If arguments allowed and provided, parse, otherwise use default payload.
-			arguments := MQTTPayload{
-				Channel:  channel,
-				Note:     note,
-				Velocity: velocity,
-			}
-			if !t.DisallowPayload && len(message.Payload()) != 0 {
-				err := json.Unmarshal(message.Payload(), &arguments)
-				if err != nil {
-					r.Log(ErrorLog, "Json Error: %s", err)
-					return
-				}
-				channel = arguments.Channel
-				note = arguments.Note
-				velocity = arguments.Velocity
-			}
+		// Give up once the max attempts are reached.
+		if r.MaxReconnectAttempts > 0 && attempt >= r.MaxReconnectAttempts {
+			r.Log(ErrorLog, "%s", err)
+			r.Log(ErrorLog, "Giving up after %d attempts.", attempt)
+			state.Store(int32(Disconnected))
+			return
+		}
 
-			// Get send function for output.
-			send, err := midi.SendTo(r.MidiOut)
-			if err != nil {
-				log.Printf("Failed to get midi sender for request: %s\n%s\n", message.Topic(), err)
-				return
-			}
+		// Log the first failure, and only log retries at debug to reduce noise for absent devices.
+		level := ErrorLog
+		if attempt > 1 {
+			level = DebugLog
+		}
+		r.Log(level, "%s", err)
+		r.Log(level, "Retrying in %s.", interval)
+		if !sleepUntilStopped(stop, interval) {
+			return
+		}
 
-			// Make the MIDI message based on information.
-			msg := midi.NoteOn(channel, note, velocity)
-			if velocity == 0 {
-				msg = midi.NoteOff(channel, note)
-			}
+		// Double the interval, up to the max.
+		interval *= 2
+		if r.MaxReconnectInterval > 0 && interval > r.MaxReconnectInterval {
+			interval = r.MaxReconnectInterval
+		}
+	}
+}
 
-			// Send MIDI message.
-			err = send(msg)
-			if err != nil {
-				log.Printf("Failed to send midi message: %s\n%s\n", message.Topic(), err)
-				return
-			}
+// Decode a channel or system exclusive MIDI message, returning false for other messages.
+func decodeMidiMessage(msg midi.Message) (MQTTPayload, bool) {
+	var channel, note, velocity, program, controller, value, pressure uint8
+	var bend int16
+	var absBend uint16
+	var sysex []byte
+	var payload MQTTPayload
+	switch {
+	// Get notes with an velocity set.
+	case msg.GetNoteStart(&channel, &note, &velocity):
+		payload = MQTTPayload{Type: NoteOnMessage, Channel: channel, Note: note, Velocity: velocity}
+
+		// If no velocity is set, an note end message is received.
+	case msg.GetNoteEnd(&channel, &note):
+		payload = MQTTPayload{Type: NoteOffMessage, Channel: channel, Note: note}
+		// Keep if it was sent as a note on, which triggers may distinguish.
+		payload.zeroVelocityNoteOn = msg.Is(midi.NoteOnMsg)
+
+		// Get program changes.
+	case msg.GetProgramChange(&channel, &program):
+		payload = MQTTPayload{Type: ProgramChangeMessage, Channel: channel, Program: program}
+
+		// Get control changes.
+	case msg.GetControlChange(&channel, &controller, &value):
+		payload = MQTTPayload{Type: ControlChangeMessage, Channel: channel, Controller: controller, Value: value}
+
+		// Get pitch bends.
+	case msg.GetPitchBend(&channel, &bend, &absBend):
+		payload = MQTTPayload{Type: PitchBendMessage, Channel: channel, Bend: bend}
+
+		// Get channel aftertouch.
+	case msg.GetAfterTouch(&channel, &pressure):
+		payload = MQTTPayload{Type: AfterTouchMessage, Channel: channel, Pressure: pressure}
+
+		// Get polyphonic aftertouch.
+	case msg.GetPolyAfterTouch(&channel, &note, &pressure):
+		payload = MQTTPayload{Type: PolyAfterTouchMessage, Channel: channel, Note: note, Pressure: pressure}
+
+		// Get system exclusive messages.
+	case msg.GetSysEx(&sysex):
+		// Copy the bytes as the message buffer may be reused.
+		payload = MQTTPayload{Type: SysExMessage, SysEx: append([]byte(nil), sysex...)}
+
+	default:
+		return payload, false
+	}
+	return payload, true
+}
+
+// Handle a MIDI message received from the named input device.
+func (r *MidiRouter) handleMidiMessage(source string, msg midi.Message, timestampms int32) {
+	payload, ok := decodeMidiMessage(msg)
+	if !ok {
+		// Get clock and transport messages, if forwarding.
+		switch {
+		case r.MQTT.ForwardClock && msg.Is(midi.TimingClockMsg):
+			r.handleClock()
+		case r.MQTT.ForwardClock && msg.Is(midi.StartMsg):
+			r.handleTransport("start")
+		case r.MQTT.ForwardClock && msg.Is(midi.StopMsg):
+			r.handleTransport("stop")
+		case r.MQTT.ForwardClock && msg.Is(midi.ContinueMsg):
+			r.handleTransport("continue")
 		}
+		return
+	}
+	if payload.Type == SysExMessage && len(payload.SysEx) > maxSysExSize {
+		r.Log(ErrorLog, "Ignoring sysex of %d bytes, larger than the maximum of %d", len(payload.SysEx), maxSysExSize)
+		return
 	}
 
-	// If standard send topic.
-	if strings.HasPrefix(message.Topic(), r.MQTT.Topic+"/send") {
-		// If arguments allowed and provided, parse, otherwise use default payload.
-		var arguments MQTTPayload
-		if len(message.Payload()) != 0 {
-			err := json.Unmarshal(message.Payload(), &arguments)
-			if err != nil {
-				r.Log(ErrorLog, "Json Error: %s", err)
-				return
-			}
-			// Get send function for output.
-			send, err := midi.SendTo(r.MidiOut)
-			if err != nil {
-				log.Printf("Failed to get midi sender for request: %s\n%s\n", message.Topic(), err)
-				return
-			}
+	payload.Source = source
+	payload.channelBase = r.ChannelDisplayBase
+	payload.Timestamp = timestampms
 
-			// Make the MIDI message based on information.
-			msg := midi.NoteOn(arguments.Channel, arguments.Note, arguments.Velocity)
-			if arguments.Velocity == 0 {
-				msg = midi.NoteOff(arguments.Channel, arguments.Note)
-			}
+	// Drop messages received too soon after the last of the same type.
+	if r.throttled(payload) {
+		return
+	}
+	r.LogWithFields(ReceiveLog, payload.Fields(), "%s", payload)
 
-			// Send MIDI message.
-			err = send(msg)
-			if err != nil {
-				log.Printf("Failed to send midi message: %s\n%s\n", message.Topic(), err)
-				return
-			}
+	// Process request.
+	r.sendRequest(payload)
+}
+
+// Check if a message was received within the minimum interval of the last of the same type, recording when it was received.
+func (r *MidiRouter) throttled(msg MQTTPayload) bool {
+	if r.MinInterval <= 0 {
+		return false
+	}
+	r.lastReceivedMu.Lock()
+	defer r.lastReceivedMu.Unlock()
+
+	// Make the map if not already made.
+	if r.lastReceived == nil {
+		r.lastReceived = make(map[MessageType]time.Time)
+	}
+
+	now := time.Now()
+	if last, ok := r.lastReceived[msg.Type]; ok && now.Sub(last) < r.MinInterval {
+		droppedMessagesTotal.WithLabelValues(r.Name, string(msg.Type)).Inc()
+		return true
+	}
+	r.lastReceived[msg.Type] = now
+	return false
+}
+
+// Log a summary of the router configuration, to catch triggers which are not registered.
+func (r *MidiRouter) LogSummary() {
+	if r.Disabled {
+		r.Log(InfoLog, "Router %s: disabled", r.Name)
+		return
+	}
+	var uris []string
+	for _, trig := range r.RequestTriggers {
+		if trig.URI != "" {
+			uris = append(uris, trig.URI)
+		}
+		if trig.URIPattern != "" {
+			uris = append(uris, trig.URIPattern)
 		}
-	} else if message.Topic() == r.MQTT.Topic+"/status/check" {
-		r.SendStatus()
 	}
+	device := r.Device
+	if r.VirtualPort {
+		device = "virtual port " + r.virtualPortName()
+	}
+	r.LogWithFields(InfoLog, log.Fields{
+		"note_triggers":    len(r.NoteTriggers),
+		"request_triggers": len(r.RequestTriggers),
+		"uris":             uris,
+		"topic":            r.MQTT.Topic,
+	}, "Router %s: device %s, %d note triggers, %d request triggers, uris %v, mqtt topic %q",
+		r.Name, device, len(r.NoteTriggers), len(r.RequestTriggers), uris, r.MQTT.Topic)
 }
 
-// Subscribe to MQTT Topic.
-func (r *MidiRouter) MqttSubscribe(topic string) {
-	r.Log(DebugLog, "Subscribing MQTT: %s", topic)
-	if t := r.MqttClient.Subscribe(topic, 0, r.MqttOnEvent); t.Wait() && t.Error() != nil {
-		r.Log(ErrorLog, "MQTT Subscribe Error: %s", t.Error())
+// Build the MQTT client options from the config.
+func (r *MidiRouter) mqttOptions() (*mqtt.ClientOptions, error) {
+	mqtt_opts := mqtt.NewClientOptions()
+	if r.MQTT.IsTLS() {
+		tlsConfig, err := r.MQTT.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		mqtt_opts.SetTLSConfig(tlsConfig)
+	}
+	mqtt_opts.AddBroker(r.MQTT.BrokerURL())
+	clientID := r.MQTT.MakeClientID()
+	r.Log(DebugLog, "MQTT client ID: %s", clientID)
+	mqtt_opts.SetClientID(clientID)
+	mqtt_opts.SetUsername(r.MQTT.User)
+	mqtt_opts.SetPassword(r.MQTT.Password)
+	// Let the client reconnect on its own after a connection is lost.
+	mqtt_opts.SetAutoReconnect(true)
+	mqtt_opts.SetMaxReconnectInterval(r.MQTT.MaxReconnectInterval)
+	mqtt_opts.SetKeepAlive(r.MQTT.KeepAlive)
+	mqtt_opts.SetConnectTimeout(r.MQTT.ConnectTimeout)
+	// Keep messages in order, so bursts of MIDI messages are not reordered.
+	if r.MQTT.OrderMatters != nil {
+		mqtt_opts.SetOrderMatters(*r.MQTT.OrderMatters)
 	}
+	mqtt_opts.SetMaxResumePubInFlight(r.MQTT.MaxResumePubInFlight)
+	// Have the broker mark us offline if the connection is lost.
+	mqtt_opts.SetWill(r.MQTT.GetAvailabilityTopic(), "offline", r.MQTT.QoS, true)
+	mqtt_opts.SetOnConnectHandler(r.MqttOnConnect)
+	mqtt_opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		r.Log(ErrorLog, "MQTT connection lost: %s", err)
+	})
+	mqtt_opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		r.Log(InfoLog, "Reconnecting to MQTT")
+	})
+	return mqtt_opts, nil
 }
 
 // Connect to MIDI devices and start listening.
 func (r *MidiRouter) Connect() {
-	// If request triggers defined, find the out port.
-	if len(r.RequestTriggers) != 0 {
-		go func() {
-			deviceRx, err := regexp.Compile(r.Device)
-			if err != nil {
-				log.Printf("Failed to compile regexp of '%s': %v", r.Device, err)
-			}
-			for {
-				var out drivers.Out
-				for _, device := range midi.GetOutPorts() {
-					if deviceRx.MatchString(device.String()) {
-						err = device.Open()
-						out = device
-					}
-				}
-				if out == nil {
-					err = fmt.Errorf("unable to find matching device")
-				}
-				if err != nil {
-					r.Log(ErrorLog, "Failed to find output device '%s': %v", r.Device, err)
-				} else {
-					r.MidiOut = out
-					break
-				}
+	r.inFlightMu.Lock()
+	r.closing = false
+	r.inFlightMu.Unlock()
 
-				r.Log(ErrorLog, "Retrying in 1 minute.")
-				time.Sleep(time.Minute)
-			}
-		}()
+	// Parse note trigger templates, falling back to the literal text on failure.
+	for i := range r.NoteTriggers {
+		err := r.NoteTriggers[i].ParseTemplates()
+		if err != nil {
+			r.Log(ErrorLog, "Failed to parse note trigger %d %s", i, err)
+		}
+	}
+
+	// Stopped on disconnect, shared by the goroutines connecting to devices.
+	stop := make(chan struct{})
+	r.portsMu.Lock()
+	r.stop = stop
+	r.portsMu.Unlock()
+
+	// Start the workers which run note triggers.
+	r.queueMu.Lock()
+	r.triggerQueue = make(chan triggerJob, triggerQueueSize)
+	r.queueMu.Unlock()
+	workers := r.MaxConcurrentTriggers
+	if workers < 1 {
+		workers = defaultMaxConcurrentTriggers
+	}
+	for i := 0; i < workers; i++ {
+		go r.triggerWorker(r.triggerQueue)
+	}
+
+	// Start sending messages to the firehose webhook.
+	if r.FirehoseWebhook.URL != "" {
+		r.webhookQueue = make(chan FirehoseMessage, triggerQueueSize)
+		go r.firehoseWebhookWorker(r.webhookQueue)
+	}
+
+	// The device regular expression is shared by the in and out ports.
+	// If it fails to compile, the devices are not connected rather than matching with a nil expression.
+	deviceRx, err := r.deviceRegexp()
+	if err != nil {
+		r.Log(ErrorLog, "Failed to compile regexp of '%s', not connecting to devices: %v", r.Device, err)
+	}
+
+	// If request triggers or forwarding defined, find the out port.
+	if r.NeedsOutput() && deviceRx != nil {
+		r.goConnecting(func() {
+			r.connectPort(stop, &r.outState, r.StartupDelay, func() error {
+				return r.connectOutput(stop, deviceRx)
+			})
+		})
 	}
 
 	// If listener is disabled, stop here.
-	if !r.DisableListener {
+	if !r.DisableListener && deviceRx != nil {
+		r.goConnecting(func() {
+			r.connectPort(stop, &r.inState, r.StartupDelay, func() error {
+				return r.connectInput(stop, deviceRx)
+			})
+		})
+	}
+
+	// Reconnect if a device is removed, such as a USB device being unplugged.
+	if !r.VirtualPort && deviceRx != nil && r.DeviceCheckInterval > 0 {
+		r.goConnecting(func() {
+			r.deviceCheckWorker(stop, deviceRx)
+		})
+	}
+
+	if r.MQTT.Host != "" && r.MQTT.Port != 0 {
 		go func() {
-			deviceRx, err := regexp.Compile(r.Device)
-			if err != nil {
-				log.Printf("Failed to compile regexp of '%s': %v", r.Device, err)
-			}
 			for {
-				// Try finding input port.
-				r.Log(InfoLog, "Connecting to input device: %s", r.Device)
-				var in drivers.In
-				for _, device := range midi.GetInPorts() {
-					if deviceRx.MatchString(device.String()) {
-						err = device.Open()
-						in = device
-					}
-				}
-				if in == nil {
-					err = fmt.Errorf("unable to find matching device")
-				}
+				// Connect to MQTT.
+				mqtt_opts, err := r.mqttOptions()
 				if err != nil {
-					r.Log(ErrorLog, "Can't find input device '%s': %v", r.Device, err)
+					r.Log(ErrorLog, "MQTT TLS error: %s", err)
 					r.Log(ErrorLog, "Retrying in 1 minute.")
-					time.Sleep(time.Minute)
+					if !sleepUntilStopped(stop, time.Minute) {
+						return
+					}
 					continue
 				}
+				client := mqtt.NewClient(mqtt_opts)
+				r.portsMu.Lock()
+				r.MqttClient = client
+				r.portsMu.Unlock()
 
-				// Start listening to MIDI messages.
-				stop, err := midi.ListenTo(in, func(msg midi.Message, timestampms int32) {
-					var channel, note, velocity uint8
-					switch {
-					// Get notes with an velocity set.
-					case msg.GetNoteStart(&channel, &note, &velocity):
-						r.Log(ReceiveLog, "starting note %s(%d) on channel %v with velocity %v", midi.Note(note), note, channel, velocity)
-						// Process request.
-						r.sendRequest(channel, note, velocity)
-
-						// If no velocity is set, an note end message is received.
-					case msg.GetNoteEnd(&channel, &note):
-						r.Log(ReceiveLog, "ending note %s(%d) on channel %v", midi.Note(note), note, channel)
-						// Process request.
-						r.sendRequest(channel, note, 0)
-					default:
-						// ignore
-					}
-				})
-				if err != nil {
-					r.Log(ErrorLog, "Error listening to device: %s", err)
+				// Connect, and retry on failure.
+				r.Log(DebugLog, "Connecting to MQTT")
+				if t := client.Connect(); t.Wait() && t.Error() != nil {
+					r.Log(ErrorLog, "MQTT error: %s", t.Error())
 					r.Log(ErrorLog, "Retrying in 1 minute.")
-					time.Sleep(time.Minute)
+					if !sleepUntilStopped(stop, time.Minute) {
+						return
+					}
 					continue
 				}
-				r.Log(InfoLog, "Connected to input device: %s", r.Device)
-
-				// Update stop function for disconnects.
-				r.ListenerStop = stop
 				break
 			}
 		}()
+
+		// Republish the status on an interval.
+		if r.MQTT.StatusInterval > 0 {
+			r.statusStop = make(chan struct{})
+			go r.statusWorker(r.statusStop)
+		}
 	}
 
-	if r.MQTT.Host != "" && r.MQTT.Port != 0 {
-		go func() {
-			for {
-				// Connect to MQTT.
-				mqtt_opts := mqtt.NewClientOptions()
-				mqtt_opts.AddBroker(fmt.Sprintf("tcp://%s:%d", r.MQTT.Host, r.MQTT.Port))
-				mqtt_opts.SetClientID(r.MQTT.ClientId)
-				mqtt_opts.SetUsername(r.MQTT.User)
-				mqtt_opts.SetPassword(r.MQTT.Password)
-				r.MqttClient = mqtt.NewClient(mqtt_opts)
-
-				// Connect and failures are fatal exiting service.
-				r.Log(DebugLog, "Connecting to MQTT")
-				if t := r.MqttClient.Connect(); t.Wait() && t.Error() != nil {
-					log.Fatalf("MQTT error: %s", t.Error())
-					r.Log(ErrorLog, "Retrying in 1 minute.")
-					time.Sleep(time.Minute)
-					continue
-				}
+	// Send and receive OSC messages, if configured.
+	r.connectOSC()
+}
 
-				// Subscribe to MQTT topics.
-				r.MqttSubscribe(r.MQTT.Topic + "/send")
-				r.MqttSubscribe(r.MQTT.Topic + "/status/check")
-				// Subscribe to command topics configured.
-				for _, trig := range r.RequestTriggers {
-					if trig.MqttTopic != "" {
-						r.MqttSubscribe(trig.MqttTopic)
-					}
-					if trig.MqttSubTopic != "" {
-						r.MqttSubscribe(r.MQTT.Topic + "/" + trig.MqttSubTopic)
-					}
-				}
-				break
+// Open the output device, unless stopped while opening.
+func (r *MidiRouter) connectOutput(stop chan struct{}, deviceRx *regexp.Regexp) error {
+	out, err := r.openOutPort(deviceRx)
+	if err != nil {
+		return fmt.Errorf("failed to find output device '%s': %v", r.Device, err)
+	}
+	r.portsMu.Lock()
+	defer r.portsMu.Unlock()
+	if stopped(stop) {
+		return nil
+	}
+	r.MidiOut = out
+	r.outWarned.Store(false)
+	r.runningStatusUnsupported.Store(false)
+	return nil
+}
+
+// Open the input devices and start listening to them, unless stopped while opening.
+func (r *MidiRouter) connectInput(stop chan struct{}, deviceRx *regexp.Regexp) error {
+	// Try finding input port.
+	r.Log(InfoLog, "Connecting to input device: %s", r.Device)
+	ins, err := r.openInPorts(deviceRx)
+	if err != nil {
+		return fmt.Errorf("can't find input device '%s': %v", r.Device, err)
+	}
+
+	// Give devices time to accept a listener after opening.
+	if r.DeviceSettleTime > 0 && !sleepUntilStopped(stop, r.DeviceSettleTime) {
+		return nil
+	}
+
+	// Only receive system exclusive messages if a trigger needs them.
+	var opts []midi.Option
+	for _, trig := range r.NoteTriggers {
+		if trig.MessageType == SysExMessage {
+			opts = append(opts, midi.UseSysEx())
+			break
+		}
+	}
+
+	// Start listening to MIDI messages on each device.
+	var stops []func()
+	var names []string
+	for _, in := range ins {
+		source := in.String()
+		stop, err := in.Listen(func(msg midi.Message, timestampms int32) {
+			r.handleMidiMessage(source, msg, timestampms)
+		}, opts...)
+		if err != nil {
+			for _, stop := range stops {
+				stop()
 			}
-		}()
+			return fmt.Errorf("error listening to device '%s': %s", in, err)
+		}
+		stops = append(stops, stop)
+		names = append(names, source)
+		r.Log(InfoLog, "Connected to input device: %s", in)
+	}
+
+	// Stop listening if disconnected while connecting, otherwise update stop functions for disconnects.
+	r.portsMu.Lock()
+	if stopped(stop) {
+		r.portsMu.Unlock()
+		for _, stop := range stops {
+			stop()
+		}
+		return nil
+	}
+	r.ListenerStops = stops
+	r.inPortNames = names
+	r.portsMu.Unlock()
+	return nil
+}
+
+// Check if each of the names is in the ports available.
+func portsPresent[T interface{ String() string }](ports []T, names ...string) bool {
+	for _, name := range names {
+		if !slices.ContainsFunc(ports, func(p T) bool { return p.String() == name }) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check the connected devices are still present on the device check interval until stopped,
+// as the driver does not report a device being removed, and reconnect to any which were removed.
+func (r *MidiRouter) deviceCheckWorker(stop chan struct{}, deviceRx *regexp.Regexp) {
+	ticker := time.NewTicker(r.DeviceCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		// Reconnect the input if a device listened to was removed.
+		r.portsMu.RLock()
+		names := r.inPortNames
+		r.portsMu.RUnlock()
+		if ConnectionState(r.inState.Load()) == Connected && !portsPresent(listInPorts(), names...) {
+			r.Log(ErrorLog, "Input device '%s' was removed, reconnecting", r.Device)
+			r.stopListening()
+			r.inState.Store(int32(Connecting))
+			r.goConnecting(func() {
+				r.connectPort(stop, &r.inState, 0, func() error {
+					return r.connectInput(stop, deviceRx)
+				})
+			})
+		}
+
+		// Reconnect the output if its device was removed.
+		out := r.midiOut()
+		if ConnectionState(r.outState.Load()) == Connected && out != nil && !portsPresent(listOutPorts(), out.String()) {
+			r.Log(ErrorLog, "Output device '%s' was removed, reconnecting", out)
+			r.portsMu.Lock()
+			r.MidiOut = nil
+			r.portsMu.Unlock()
+			r.outState.Store(int32(Connecting))
+			r.goConnecting(func() {
+				r.connectPort(stop, &r.outState, 0, func() error {
+					return r.connectOutput(stop, deviceRx)
+				})
+			})
+		}
+	}
+}
+
+// Publish the status on the status interval until stopped.
+func (r *MidiRouter) statusWorker(stop chan struct{}) {
+	ticker := time.NewTicker(r.MQTT.StatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if r.mqttConnected() {
+				r.SendStatus()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Check if the configuration of another router matches this router.
+func (r *MidiRouter) ConfigEqual(o *MidiRouter) bool {
+	a, err := json.Marshal(r)
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(o)
+	if err != nil {
+		return false
+	}
+	if !bytes.Equal(a, b) {
+		return false
+	}
+
+	// Secrets are redacted when encoded, so compare them separately.
+	if r.MQTT.Password != o.MQTT.Password || !maps.EqualFunc(r.FirehoseWebhook.Headers, o.FirehoseWebhook.Headers, slices.Equal) {
+		return false
+	}
+	for i, trig := range r.NoteTriggers {
+		other := o.NoteTriggers[i]
+		if trig.BasicAuthPassword != other.BasicAuthPassword || trig.BearerToken != other.BearerToken ||
+			!maps.EqualFunc(trig.Headers, other.Headers, slices.Equal) {
+			return false
+		}
+	}
+	return true
+}
+
+// Count a request from a listener or handler as in-flight, returning false if the router is disconnecting.
+// Requests already in-flight add the work they start to inFlight directly, as it is not yet drained.
+func (r *MidiRouter) beginWork() bool {
+	r.inFlightMu.Lock()
+	defer r.inFlightMu.Unlock()
+	if r.closing {
+		return false
+	}
+	r.inFlight.Add(1)
+	return true
+}
+
+// Wait for in-flight requests to complete, up to the shutdown grace period.
+func (r *MidiRouter) waitInFlight() {
+	// Stop new requests from starting, so none are added while waiting.
+	r.inFlightMu.Lock()
+	r.closing = true
+	r.inFlightMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.inFlight.Wait()
+		close(done)
+	}()
+
+	// Without a grace period, wait until complete.
+	if r.ShutdownGracePeriod <= 0 {
+		<-done
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(r.ShutdownGracePeriod):
+		r.Log(ErrorLog, "Triggers still in progress after %s, disconnecting anyway", r.ShutdownGracePeriod)
 	}
 }
 
 // On disconnect, stop and remove output device.
 func (r *MidiRouter) Disconnect() {
+	// Stop connecting to devices, with the lock held so devices connecting are not kept after.
+	r.portsMu.Lock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	r.portsMu.Unlock()
+
+	// Wait for devices being connected, which are not kept once stopped.
+	r.connecting.Wait()
+
+	// Stop receiving new messages.
+	r.stopListening()
+	if r.statusStop != nil {
+		close(r.statusStop)
+		r.statusStop = nil
+	}
+	if r.oscConn != nil {
+		r.oscConn.Close()
+		r.oscConn = nil
+	}
+
+	// Send coalesced messages waiting to settle, then wait for in-flight requests,
+	// which may still publish to MQTT, send OSC, and send to the output device.
+	r.flushCoalesced()
+	r.waitInFlight()
+	r.oscClient = nil
+	if client := r.mqttClient(); client != nil {
+		// Mark offline, as the will is not sent on a clean disconnect.
+		if client.IsConnectionOpen() {
+			if r.MQTT.HomeAssistantDiscovery {
+				r.RemoveHomeAssistantDiscovery()
+			}
+			t := r.mqttPublish(r.MQTT.GetAvailabilityTopic(), r.MQTT.QoS, true, "offline")
+			t.WaitTimeout(time.Second)
+		}
+		client.Disconnect(250)
+	}
+	r.portsMu.Lock()
 	r.MidiOut = nil
-	if r.ListenerStop != nil {
-		r.ListenerStop()
+	r.portsMu.Unlock()
+	r.inState.Store(int32(Disconnected))
+	r.outState.Store(int32(Disconnected))
+
+	// Stop the trigger workers, with triggers queued after dropped.
+	r.queueMu.Lock()
+	if r.triggerQueue != nil {
+		close(r.triggerQueue)
+		r.triggerQueue = nil
 	}
-	if r.MqttClient != nil {
-		r.MqttClient.Disconnect(0)
+	r.queueMu.Unlock()
+
+	// Stop the firehose webhook, which sends any messages remaining in the batch.
+	if r.webhookQueue != nil {
+		close(r.webhookQueue)
+		r.webhookQueue = nil
 	}
 }
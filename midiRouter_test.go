@@ -0,0 +1,807 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"gitlab.com/gomidi/midi/v2"
+)
+
+// An MQTT message received on a topic.
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 0 }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) Ack()              {}
+
+// A message published to the MQTT broker.
+type publishedMessage struct {
+	topic   string
+	payload string
+}
+
+// An MQTT client which records the messages published, as if connected until disconnected.
+type fakeMqttClient struct {
+	mqtt.Client
+	mu           sync.Mutex
+	published    []publishedMessage
+	disconnected bool
+}
+
+func (c *fakeMqttClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.disconnected
+}
+
+func (c *fakeMqttClient) IsConnectionOpen() bool {
+	return c.IsConnected()
+}
+
+func (c *fakeMqttClient) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disconnected = true
+}
+
+// Record the message published, dropping messages published once disconnected.
+func (c *fakeMqttClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.disconnected {
+		return dryRunToken{}
+	}
+	var text string
+	switch v := payload.(type) {
+	case []byte:
+		text = string(v)
+	case string:
+		text = v
+	}
+	c.published = append(c.published, publishedMessage{topic: topic, payload: text})
+	return dryRunToken{}
+}
+
+// Get the messages published.
+func (c *fakeMqttClient) Published() []publishedMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]publishedMessage(nil), c.published...)
+}
+
+// Check the messages sent to a port are those expected.
+func assertSent(t *testing.T, out *fakeOutPort, want ...midi.Message) {
+	t.Helper()
+	got := out.Sent()
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		trigger RequestTrigger
+		method  string
+		target  string
+		body    string
+		status  int
+		want    []midi.Message
+	}{
+		{
+			name:    "default message",
+			trigger: RequestTrigger{URI: "/note", Note: 60, Velocity: 100, SuccessStatus: http.StatusNoContent},
+			method:  http.MethodGet,
+			target:  "/note",
+			status:  http.StatusNoContent,
+			want:    []midi.Message{midi.NoteOn(0, 60, 100)},
+		},
+		{
+			name:    "query values",
+			trigger: RequestTrigger{URI: "/note", MidiInfoInRequest: true, SuccessStatus: http.StatusNoContent},
+			method:  http.MethodGet,
+			target:  "/note?channel=2&note=64&velocity=90",
+			status:  http.StatusNoContent,
+			want:    []midi.Message{midi.NoteOn(2, 64, 90)},
+		},
+		{
+			name:    "query ignored without midi info in request",
+			trigger: RequestTrigger{URI: "/note", Note: 60, Velocity: 100, SuccessStatus: http.StatusNoContent},
+			method:  http.MethodGet,
+			target:  "/note?note=64",
+			status:  http.StatusNoContent,
+			want:    []midi.Message{midi.NoteOn(0, 60, 100)},
+		},
+		{
+			name:    "query out of range",
+			trigger: RequestTrigger{URI: "/note", MidiInfoInRequest: true, SuccessStatus: http.StatusNoContent},
+			method:  http.MethodGet,
+			target:  "/note?velocity=200",
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "json body",
+			trigger: RequestTrigger{URI: "/note", MidiInfoInRequest: true, SuccessStatus: http.StatusNoContent},
+			method:  http.MethodPost,
+			target:  "/note",
+			body:    `{"type":"control_change","controller":7,"value":64}`,
+			status:  http.StatusNoContent,
+			want:    []midi.Message{midi.ControlChange(0, 7, 64)},
+		},
+		{
+			name:    "json body unsupported type",
+			trigger: RequestTrigger{URI: "/note", MidiInfoInRequest: true, SuccessStatus: http.StatusNoContent},
+			method:  http.MethodPost,
+			target:  "/note",
+			body:    `{"type":"clock","note":60}`,
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "method not allowed",
+			trigger: RequestTrigger{URI: "/note", AllowedMethods: []string{"post"}, SuccessStatus: http.StatusNoContent},
+			method:  http.MethodGet,
+			target:  "/note",
+			status:  http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "unknown uri",
+			trigger: RequestTrigger{URI: "/note", SuccessStatus: http.StatusNoContent},
+			method:  http.MethodGet,
+			target:  "/other",
+			status:  http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &fakeOutPort{name: "out"}
+			r := &MidiRouter{RequestTriggers: []RequestTrigger{tt.trigger}, MidiOut: out}
+
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			w := httptest.NewRecorder()
+			r.Handler(w, req)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			assertSent(t, out, tt.want...)
+		})
+	}
+}
+
+func TestHandlerWithoutOutput(t *testing.T) {
+	r := &MidiRouter{RequestTriggers: []RequestTrigger{{URI: "/note", SuccessStatus: http.StatusNoContent}}}
+
+	w := httptest.NewRecorder()
+	r.Handler(w, httptest.NewRequest(http.MethodGet, "/note", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestSendRequestMatching(t *testing.T) {
+	tests := []struct {
+		name    string
+		trigger NoteTrigger
+		msg     MQTTPayload
+		match   bool
+	}{
+		{
+			name:    "note and velocity",
+			trigger: NoteTrigger{Channel: 1, Note: 60, Velocity: 100},
+			msg:     MQTTPayload{Type: NoteOnMessage, Channel: 1, Note: 60, Velocity: 100},
+			match:   true,
+		},
+		{
+			name:    "other channel",
+			trigger: NoteTrigger{Channel: 1, Note: 60, Velocity: 100},
+			msg:     MQTTPayload{Type: NoteOnMessage, Channel: 2, Note: 60, Velocity: 100},
+		},
+		{
+			name:    "all channels",
+			trigger: NoteTrigger{MatchAllChannels: true, Note: 60, Velocity: 100},
+			msg:     MQTTPayload{Type: NoteOnMessage, Channel: 2, Note: 60, Velocity: 100},
+			match:   true,
+		},
+		{
+			name:    "other velocity",
+			trigger: NoteTrigger{Note: 60, Velocity: 100},
+			msg:     MQTTPayload{Type: NoteOnMessage, Note: 60, Velocity: 90},
+		},
+		{
+			name:    "all velocities",
+			trigger: NoteTrigger{Note: 60, MatchAllVelocities: true},
+			msg:     MQTTPayload{Type: NoteOnMessage, Note: 60, Velocity: 90},
+			match:   true,
+		},
+		{
+			name:    "note off only",
+			trigger: NoteTrigger{Note: 60, MatchAllVelocities: true, MatchNoteOffOnly: true},
+			msg:     MQTTPayload{Type: NoteOnMessage, Note: 60, Velocity: 90},
+		},
+		{
+			name:    "note range",
+			trigger: NoteTrigger{NoteMin: 36, NoteMax: 43, MatchAllVelocities: true},
+			msg:     MQTTPayload{Type: NoteOnMessage, Note: 40, Velocity: 90},
+			match:   true,
+		},
+		{
+			name:    "note above range",
+			trigger: NoteTrigger{NoteMin: 36, NoteMax: 43, MatchAllVelocities: true},
+			msg:     MQTTPayload{Type: NoteOnMessage, Note: 44, Velocity: 90},
+		},
+		{
+			name:    "note range without max",
+			trigger: NoteTrigger{NoteMin: 60, MatchAllVelocities: true},
+			msg:     MQTTPayload{Type: NoteOnMessage, Note: 127, Velocity: 90},
+			match:   true,
+		},
+		{
+			name:    "note below range without max",
+			trigger: NoteTrigger{NoteMin: 60, MatchAllVelocities: true},
+			msg:     MQTTPayload{Type: NoteOnMessage, Note: 59, Velocity: 90},
+		},
+		{
+			name:    "other type",
+			trigger: NoteTrigger{MessageType: ProgramChangeMessage, Program: 5},
+			msg:     MQTTPayload{Type: NoteOnMessage, Note: 5, Velocity: 5},
+		},
+		{
+			name:    "program",
+			trigger: NoteTrigger{MessageType: ProgramChangeMessage, Program: 5},
+			msg:     MQTTPayload{Type: ProgramChangeMessage, Program: 5},
+			match:   true,
+		},
+		{
+			name:    "controller",
+			trigger: NoteTrigger{MessageType: ControlChangeMessage, Controller: 7, MatchAllValues: true},
+			msg:     MQTTPayload{Type: ControlChangeMessage, Controller: 7, Value: 64},
+			match:   true,
+		},
+		{
+			name:    "other controller",
+			trigger: NoteTrigger{MessageType: ControlChangeMessage, Controller: 7, MatchAllValues: true},
+			msg:     MQTTPayload{Type: ControlChangeMessage, Controller: 10, Value: 64},
+		},
+		{
+			name:    "controller value",
+			trigger: NoteTrigger{MessageType: ControlChangeMessage, MatchAllControllers: true, Value: 127},
+			msg:     MQTTPayload{Type: ControlChangeMessage, Controller: 64, Value: 0},
+		},
+		{
+			name:    "sysex prefix",
+			trigger: NoteTrigger{MessageType: SysExMessage, SysExPrefix: "7E 7F"},
+			msg:     MQTTPayload{Type: SysExMessage, SysEx: []byte{0x7E, 0x7F, 0x06, 0x01}},
+			match:   true,
+		},
+		{
+			name:    "other sysex prefix",
+			trigger: NoteTrigger{MessageType: SysExMessage, SysExPrefix: "7E 7F"},
+			msg:     MQTTPayload{Type: SysExMessage, SysEx: []byte{0x7E, 0x00}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &MidiRouter{NoteTriggers: []NoteTrigger{tt.trigger}, triggerQueue: make(chan triggerJob, 1)}
+			r.sendRequest(tt.msg)
+			if got := len(r.triggerQueue) == 1; got != tt.match {
+				t.Errorf("queued %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestMqttSend(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		want    []midi.Message
+	}{
+		{
+			name:    "note",
+			topic:   "midi/test/send",
+			payload: `{"channel":1,"note":60,"velocity":100}`,
+			want:    []midi.Message{midi.NoteOn(1, 60, 100)},
+		},
+		{
+			name:    "control change",
+			topic:   "midi/test/send",
+			payload: `{"type":"control_change","channel":0,"controller":7,"value":64}`,
+			want:    []midi.Message{midi.ControlChange(0, 7, 64)},
+		},
+		{
+			name:    "out of range",
+			topic:   "midi/test/send",
+			payload: `{"channel":16,"note":60,"velocity":100}`,
+		},
+		{
+			name:    "unsupported type",
+			topic:   "midi/test/send",
+			payload: `{"type":"clock","note":60,"velocity":100}`,
+		},
+		{
+			name:    "invalid json",
+			topic:   "midi/test/send",
+			payload: `{"note":`,
+		},
+		{
+			name:    "request trigger",
+			topic:   "midi/test/trigger",
+			payload: `{"type":"program_change","program":5}`,
+			want:    []midi.Message{midi.ProgramChange(0, 5)},
+		},
+		{
+			name:    "request trigger unsupported type",
+			topic:   "midi/test/trigger",
+			payload: `{"type":"clock","note":60,"velocity":100}`,
+		},
+		{
+			name:    "other topic",
+			topic:   "midi/other/send",
+			payload: `{"note":60,"velocity":100}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &fakeOutPort{name: "out"}
+			r := &MidiRouter{MQTT: MQTTConfig{Topic: "midi/test"}, MidiOut: out, RequestTriggers: []RequestTrigger{{MqttSubTopic: "trigger"}}}
+			r.MqttOnEvent(nil, &fakeMessage{topic: tt.topic, payload: []byte(tt.payload)})
+			assertSent(t, out, tt.want...)
+		})
+	}
+}
+
+func TestSendRequestAfterDisconnect(t *testing.T) {
+	r := &MidiRouter{DisableListener: true, NoteTriggers: []NoteTrigger{{MatchAllNotes: true, MatchAllVelocities: true}}}
+	r.Connect()
+	r.Disconnect()
+
+	// Messages received after disconnecting are dropped, rather than sent on the closed queue.
+	r.sendRequest(MQTTPayload{Type: NoteOnMessage, Note: 60, Velocity: 100})
+	r.waitInFlight()
+}
+
+func TestRequestAfterDisconnect(t *testing.T) {
+	out := &fakeOutPort{name: "out"}
+	r := &MidiRouter{DisableListener: true, RequestTriggers: []RequestTrigger{{URI: "/note", Note: 60, Velocity: 100}}}
+	r.Connect()
+	r.Disconnect()
+	r.MidiOut = out
+
+	// Requests received while disconnecting are rejected, rather than counted after the drain.
+	w := httptest.NewRecorder()
+	r.Handler(w, httptest.NewRequest(http.MethodGet, "/note", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	assertSent(t, out)
+	r.waitInFlight()
+}
+
+func TestConnectStopsOnDisconnect(t *testing.T) {
+	devices := useFakeDevices(t)
+	r := &MidiRouter{Device: "keys", ReconnectInterval: 5 * time.Millisecond}
+	r.Connect()
+	r.Disconnect()
+
+	// A device appearing after disconnecting is not connected to.
+	in := &fakeInPort{name: "keys"}
+	devices.Add(in, nil)
+	time.Sleep(50 * time.Millisecond)
+	if in.Listening() {
+		t.Error("listening to device after disconnect")
+	}
+	if state := r.ConnectionState(); state != Disconnected {
+		t.Errorf("state %s, want %s", state, Disconnected)
+	}
+}
+
+// Wait for a condition to be met, failing the test if it is not met within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDeviceAppearsAfterStartup(t *testing.T) {
+	devices := useFakeDevices(t)
+	r := &MidiRouter{
+		Device:            "keys",
+		ReconnectInterval: 5 * time.Millisecond,
+		NoteTriggers:      []NoteTrigger{{MatchAllChannels: true, MatchAllNotes: true, MatchAllVelocities: true, ForwardToOutput: true, OutputChannel: new(uint8)}},
+	}
+	r.Connect()
+	defer r.Disconnect()
+	time.Sleep(20 * time.Millisecond)
+	if state := r.ConnectionState(); state != Connecting {
+		t.Fatalf("state %s, want %s", state, Connecting)
+	}
+
+	// Once the device is plugged in, messages are received and forwarded to it.
+	in := &fakeInPort{name: "keys in"}
+	out := &fakeOutPort{name: "keys out"}
+	devices.Add(in, out)
+	waitFor(t, "connection", func() bool { return r.ConnectionState() == Connected })
+	in.Inject(midi.NoteOn(3, 60, 100))
+	assertSent(t, out, midi.NoteOn(0, 60, 100))
+}
+
+func TestDeviceRemovedReconnects(t *testing.T) {
+	devices := useFakeDevices(t)
+	in := &fakeInPort{name: "keys in"}
+	devices.Add(in, nil)
+	r := &MidiRouter{Device: "keys", ReconnectInterval: time.Millisecond, DeviceCheckInterval: time.Millisecond}
+	r.Connect()
+	defer r.Disconnect()
+	waitFor(t, "connection", in.Listening)
+
+	// Once unplugged the device stops being listened to, and is listened to again when plugged back in.
+	devices.RemoveAll()
+	waitFor(t, "device removal", func() bool { return !in.Listening() })
+	if state := r.ConnectionState(); state != Connecting {
+		t.Errorf("state %s, want %s", state, Connecting)
+	}
+	devices.Add(in, nil)
+	waitFor(t, "reconnection", in.Listening)
+	waitFor(t, "connected state", func() bool { return r.ConnectionState() == Connected })
+}
+
+func TestCoalesceSentOnDisconnect(t *testing.T) {
+	requests := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests <- req.URL.Path
+	}))
+	defer srv.Close()
+	r := &MidiRouter{
+		DisableListener: true,
+		NoteTriggers: []NoteTrigger{{
+			MessageType:         ControlChangeMessage,
+			MatchAllControllers: true,
+			MatchAllValues:      true,
+			Coalesce:            time.Hour,
+			URL:                 srv.URL + "/{{.Value}}",
+		}},
+	}
+	r.Connect()
+
+	// Only the latest of the messages waiting to settle is sent when disconnecting.
+	for _, value := range []uint8{10, 20, 30} {
+		r.sendRequest(MQTTPayload{Type: ControlChangeMessage, Controller: 7, Value: value})
+	}
+	r.Disconnect()
+	close(requests)
+	var got []string
+	for path := range requests {
+		got = append(got, path)
+	}
+	if !slices.Equal(got, []string{"/30"}) {
+		t.Errorf("requests %v, want [/30]", got)
+	}
+
+	// Messages after disconnecting are dropped once they settle.
+	r.NoteTriggers[0].Coalesce = time.Millisecond
+	r.sendRequest(MQTTPayload{Type: ControlChangeMessage, Controller: 7, Value: 40})
+	time.Sleep(10 * time.Millisecond)
+	r.waitInFlight()
+}
+
+func TestCheckRange(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  MQTTPayload
+		err  string
+	}{
+		{name: "in range", msg: MQTTPayload{Channel: 15, Note: 127, Velocity: 127, Bend: -8192}},
+		{name: "channel", msg: MQTTPayload{Channel: 16}, err: "channel must be a number from 0 to 15"},
+		{name: "first of several", msg: MQTTPayload{Note: 128, Velocity: 128, Pressure: 128}, err: "note must be a number from 0 to 127"},
+		{name: "controller before value", msg: MQTTPayload{Controller: 200, Value: 200}, err: "controller must be a number from 0 to 127"},
+		{name: "bend", msg: MQTTPayload{Bend: 8192}, err: "bend must be a number from -8192 to 8191"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Repeat, as the same field must be reported each time.
+			for i := 0; i < 20; i++ {
+				err := tt.msg.CheckRange()
+				got := ""
+				if err != nil {
+					got = err.Error()
+				}
+				if got != tt.err {
+					t.Fatalf("error %q, want %q", got, tt.err)
+				}
+			}
+		})
+	}
+}
+
+func TestTriggerErrorStatusLogged(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() {
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	})
+
+	// The status is logged even though the router only logs info messages.
+	r := &MidiRouter{LogLevel: InfoLog}
+	trig := &NoteTrigger{URL: srv.URL + "/hook"}
+	r.runTrigger(trig, MQTTPayload{Type: NoteOnMessage, Note: 60, Velocity: 100})
+	var logged bool
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.ErrorLevel && strings.Contains(entry.Message, "responded with 500") {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Error("error status not logged")
+	}
+}
+
+func TestTriggerMidiInfoInRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  MQTTPayload
+		want string
+	}{
+		{
+			name: "note",
+			msg:  MQTTPayload{Type: NoteOnMessage, Channel: 1, Note: 60, Velocity: 100},
+			want: "channel=1&note=60&timestamp=0&velocity=100",
+		},
+		{
+			name: "control change",
+			msg:  MQTTPayload{Type: ControlChangeMessage, Channel: 2, Controller: 7, Value: 64},
+			want: "channel=2&controller=7&timestamp=0&value=64",
+		},
+		{
+			name: "program change",
+			msg:  MQTTPayload{Type: ProgramChangeMessage, Channel: 3, Program: 5},
+			want: "channel=3&program=5&timestamp=0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, queries := newQueryServer(t)
+			r := &MidiRouter{}
+			r.runTrigger(&NoteTrigger{URL: srv.URL, MidiInfoInRequest: true}, tt.msg)
+			if got := <-queries; got != tt.want {
+				t.Errorf("query %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Start a server sending the query of each request made to it.
+func newQueryServer(t *testing.T) (*httptest.Server, <-chan string) {
+	queries := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		queries <- req.URL.RawQuery
+	}))
+	t.Cleanup(srv.Close)
+	return srv, queries
+}
+
+// Start a server counting the requests and connections made to it.
+func newCountingServer(t testing.TB) (*httptest.Server, *atomic.Int64, *atomic.Int64) {
+	var requests, conns atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, &requests, &conns
+}
+
+// Make a router connected without devices, which sends each note to the URL.
+func newTriggerRouter(url string) *MidiRouter {
+	r := &MidiRouter{
+		DisableListener:       true,
+		MaxConcurrentTriggers: 1,
+		NoteTriggers:          []NoteTrigger{{MatchAllNotes: true, MatchAllVelocities: true, URL: url, Body: `{"note":{{.Note}}}`}},
+	}
+	r.Connect()
+	return r
+}
+
+func TestTriggerRequestsReuseConnections(t *testing.T) {
+	srv, requests, conns := newCountingServer(t)
+	r := newTriggerRouter(srv.URL)
+
+	// A firehose of notes is sent over one kept alive connection.
+	for i := 0; i < 1000; i++ {
+		r.sendRequest(MQTTPayload{Type: NoteOnMessage, Note: uint8(i % 128), Velocity: 100})
+	}
+	r.Disconnect()
+	if got := requests.Load(); got != 1000 {
+		t.Errorf("%d requests, want 1000", got)
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("%d connections, want 1", got)
+	}
+}
+
+func BenchmarkTriggerRequests(b *testing.B) {
+	srv, _, conns := newCountingServer(b)
+	r := newTriggerRouter(srv.URL)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.sendRequest(MQTTPayload{Type: NoteOnMessage, Note: uint8(i % 128), Velocity: 100})
+	}
+	r.Disconnect()
+	b.ReportMetric(float64(conns.Load()), "conns")
+}
+
+func TestTriggersDoNotBlockListener(t *testing.T) {
+	srv, requests, _ := newCountingServer(t)
+	devices := useFakeDevices(t)
+	in := &fakeInPort{name: "keys"}
+	devices.Add(in, nil)
+	r := &MidiRouter{
+		Device:       "keys",
+		NoteTriggers: []NoteTrigger{{MatchAllNotes: true, MatchAllVelocities: true, DelayBefore: 200 * time.Millisecond, URL: srv.URL}},
+	}
+	r.Connect()
+	defer r.Disconnect()
+	waitFor(t, "connection", in.Listening)
+
+	// Receiving returns while the triggers wait, and the default workers wait at the same time.
+	start := time.Now()
+	in.Inject(midi.NoteOn(0, 60, 100))
+	in.Inject(midi.NoteOn(0, 62, 100))
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("receiving took %s", elapsed)
+	}
+	waitFor(t, "requests", func() bool { return requests.Load() == 2 })
+	if elapsed := time.Since(start); elapsed > 350*time.Millisecond {
+		t.Errorf("triggers took %s, want them to run concurrently", elapsed)
+	}
+}
+
+func TestTriggerMqttPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		payload interface{}
+		want    publishedMessage
+	}{
+		{
+			name:    "string template",
+			topic:   "home/keys",
+			payload: "{{.Channel}}/{{.Note}}/{{.Velocity}}/{{.NoteName}}",
+			want:    publishedMessage{topic: "home/keys", payload: "1/60/100/C5"},
+		},
+		{
+			name:    "map with templates",
+			topic:   "home/keys",
+			payload: map[string]interface{}{"note": "{{.Note}}", "scene": 1},
+			want:    publishedMessage{topic: "home/keys", payload: `{"note":"60","scene":1}`},
+		},
+		{
+			name:    "map without templates",
+			topic:   "home/keys",
+			payload: map[string]interface{}{"scene": 1},
+			want:    publishedMessage{topic: "home/keys", payload: `{"scene":1}`},
+		},
+		{
+			name:    "string without templates",
+			topic:   "home/keys",
+			payload: "on",
+			want:    publishedMessage{topic: "home/keys", payload: `"on"`},
+		},
+		{
+			name:  "default payload",
+			topic: "home/keys/{{.Note}}",
+			want:  publishedMessage{topic: "home/keys/60", payload: `{"type":"note_on","channel":1,"note":60,"velocity":100,"timestamp":0}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := new(fakeMqttClient)
+			r := &MidiRouter{MqttClient: client}
+			trig := &NoteTrigger{MqttTopic: tt.topic, MqttPayload: tt.payload}
+			if err := trig.ParseTemplates(); err != nil {
+				t.Fatal(err)
+			}
+			r.runTrigger(trig, MQTTPayload{Type: NoteOnMessage, Channel: 1, Note: 60, Velocity: 100})
+			got := client.Published()
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("published %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTriggerDebounce(t *testing.T) {
+	srv, requests, _ := newCountingServer(t)
+	r := newTriggerRouter(srv.URL)
+	r.NoteTriggers[0].Debounce = time.Minute
+
+	// Rapid repeats of a note fire once, while another note fires on its own.
+	for _, note := range []uint8{60, 60, 60, 62} {
+		r.sendRequest(MQTTPayload{Type: NoteOnMessage, Note: note, Velocity: 100})
+	}
+	r.Disconnect()
+	if got := requests.Load(); got != 2 {
+		t.Errorf("%d requests, want 2", got)
+	}
+}
+
+func TestDisconnectPublishesInFlightTriggers(t *testing.T) {
+	client := new(fakeMqttClient)
+	r := &MidiRouter{
+		DisableListener: true,
+		MQTT:            MQTTConfig{Topic: "midi"},
+		NoteTriggers:    []NoteTrigger{{MatchAllNotes: true, MatchAllVelocities: true, DelayBefore: 50 * time.Millisecond, MqttTopic: "keys"}},
+	}
+	r.Connect()
+	r.portsMu.Lock()
+	r.MqttClient = client
+	r.portsMu.Unlock()
+
+	// The trigger waiting to run is published before the client disconnects, followed by the offline status.
+	r.sendRequest(MQTTPayload{Type: NoteOnMessage, Note: 60, Velocity: 100})
+	r.Disconnect()
+	var topics []string
+	for _, msg := range client.Published() {
+		topics = append(topics, msg.topic)
+	}
+	if want := []string{"keys", r.MQTT.GetAvailabilityTopic()}; len(topics) < 2 || !slices.Equal(topics[len(topics)-2:], want) {
+		t.Errorf("published to %v, want to end with %v", topics, want)
+	}
+}
+
+func TestQueueTriggerFullOnDisconnect(t *testing.T) {
+	// A full queue without free workers, as when the workers are stuck on slow requests.
+	r := &MidiRouter{stop: make(chan struct{}), triggerQueue: make(chan triggerJob)}
+	queued := make(chan bool)
+	r.inFlight.Add(1)
+	go func() {
+		queued <- r.queueTrigger(triggerJob{trig: &NoteTrigger{}, msg: MQTTPayload{Note: 60}})
+	}()
+
+	// Disconnecting drops the trigger waiting on the queue, so the queue can be closed.
+	close(r.stop)
+	select {
+	case ok := <-queued:
+		if ok {
+			t.Error("trigger queued after disconnect")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queueing blocked after disconnect")
+	}
+	r.queueMu.Lock()
+	close(r.triggerQueue)
+	r.queueMu.Unlock()
+	r.waitInFlight()
+}
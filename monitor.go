@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
+
+	"gitlab.com/gomidi/midi/v2"
+)
+
+// Print the MIDI messages received from the input devices matching the regular expression until interrupted.
+func monitor(device string) error {
+	deviceRx, err := regexp.Compile(device)
+	if err != nil {
+		return fmt.Errorf("invalid device regexp '%s': %v", device, err)
+	}
+	ins, err := findPorts(midi.GetInPorts(), deviceRx)
+	if err != nil {
+		return fmt.Errorf("can't find input device '%s': %v", device, err)
+	}
+
+	// Listen to each device matching.
+	for _, in := range ins {
+		source := in.String()
+		stop, err := midi.ListenTo(in, func(msg midi.Message, timestampms int32) {
+			printMidiMessage(os.Stdout, source, msg)
+		}, midi.UseSysEx())
+		if err != nil {
+			return fmt.Errorf("error listening to device '%s': %s", in, err)
+		}
+		defer stop()
+		fmt.Printf("Monitoring %s\n", source)
+	}
+	fmt.Println("Press Ctrl-C to stop.")
+
+	// Wait for an interrupt.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	<-c
+	return nil
+}
+
+// Print a MIDI message with its decoded values to the writer.
+func printMidiMessage(w io.Writer, source string, msg midi.Message) {
+	// Skip the timing clock and active sensing, which are sent continuously.
+	if msg.Is(midi.TimingClockMsg) || msg.Is(midi.ActiveSenseMsg) {
+		return
+	}
+
+	now := time.Now().Format("15:04:05.000")
+	payload, ok := decodeMidiMessage(msg)
+	if !ok {
+		fmt.Fprintf(w, "%s [%s] %s\n", now, source, msg)
+		return
+	}
+	fmt.Fprintf(w, "%s [%s] %-15s %s\n", now, source, payload.TypeName(), payload)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gitlab.com/gomidi/midi/v2"
+)
+
+func TestPrintMidiMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  midi.Message
+		want string
+	}{
+		{
+			name: "note on",
+			msg:  midi.NoteOn(0, 60, 100),
+			want: "[keys] note_on         starting note C5(60) on channel 0 with velocity 100",
+		},
+		{
+			name: "control change",
+			msg:  midi.ControlChange(1, 7, 64),
+			want: "[keys] control_change  control change 7 on channel 1 with value 64",
+		},
+		{
+			name: "program change",
+			msg:  midi.ProgramChange(2, 5),
+			want: "[keys] program_change  program change 5 on channel 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			printMidiMessage(&b, "keys", tt.msg)
+			// Remove the time the message was printed.
+			_, got, _ := strings.Cut(strings.TrimSpace(b.String()), " ")
+			if got != tt.want {
+				t.Errorf("printed %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Timing clock messages are not printed.
+	var b strings.Builder
+	printMidiMessage(&b, "keys", midi.TimingClock())
+	if b.Len() != 0 {
+		t.Errorf("printed %q for timing clock", b.String())
+	}
+}
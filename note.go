@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MIDI note number, which may be configured as a number or a note name such as C5 or F#3.
+// Names use the same octaves as the note names logged, with note 60 being C5.
+type NoteNumber uint8
+
+// Semitones of each note letter above C.
+var noteSemitones = map[byte]int{
+	'C': 0,
+	'D': 2,
+	'E': 4,
+	'F': 5,
+	'G': 7,
+	'A': 9,
+	'B': 11,
+}
+
+// Parse a note number or name from the config.
+func (n *NoteNumber) UnmarshalString(s string) error {
+	s = strings.TrimSpace(s)
+	if num, err := strconv.ParseUint(s, 10, 8); err == nil {
+		if num > maxMidiValue {
+			return fmt.Errorf("note %d is above %d", num, maxMidiValue)
+		}
+		*n = NoteNumber(num)
+		return nil
+	}
+
+	// Parse the letter, accidentals, and octave.
+	if s == "" {
+		return fmt.Errorf("invalid note name: %q", s)
+	}
+	semitone, ok := noteSemitones[strings.ToUpper(s)[0]]
+	if !ok {
+		return fmt.Errorf("invalid note name: %q", s)
+	}
+	rest := s[1:]
+	for len(rest) != 0 && (rest[0] == '#' || rest[0] == 'b') {
+		if rest[0] == '#' {
+			semitone++
+		} else {
+			semitone--
+		}
+		rest = rest[1:]
+	}
+	octave, err := strconv.Atoi(rest)
+	if err != nil {
+		return fmt.Errorf("invalid note name: %q, expected a name such as C5 or F#3", s)
+	}
+	num := octave*12 + semitone
+	if num < 0 || num > maxMidiValue {
+		return fmt.Errorf("note %s is outside the MIDI range", s)
+	}
+	*n = NoteNumber(num)
+	return nil
+}
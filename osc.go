@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/hypebeast/go-osc/osc"
+	log "github.com/sirupsen/logrus"
+)
+
+// Configurations relating to OSC messages.
+type OSCConfig struct {
+	// Host and port OSC messages of note triggers are sent to, such as `192.168.1.20:53000`.
+	SendAddress string `fig:"send_address"`
+	// Address and port to listen for OSC messages on, such as `:8000`. Do not set to not listen.
+	ListenAddress string `fig:"listen_address"`
+	// Address prefix of OSC messages received which send MIDI messages.
+	// Set prefix to `/midi` and the following addresses are handled.
+	// /midi/note - Arguments of channel, note, and velocity are sent as a note.
+	// /midi/control_change - Arguments of channel, controller, and value are sent as a control change.
+	// /midi/panic - Send all notes off on all channels.
+	Prefix string `fig:"prefix" default:"/midi"`
+}
+
+// Get the host and port of the send address.
+func (c *OSCConfig) SendHostPort() (string, int, error) {
+	host, port, err := net.SplitHostPort(c.SendAddress)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return "", 0, fmt.Errorf("invalid port: %s", port)
+	}
+	return host, p, nil
+}
+
+// MIDI info of the arguments of OSC messages for each message type, in order.
+var oscArgumentFields = map[MessageType][]string{
+	NoteMessage:           {"channel", "note", "velocity"},
+	NoteOnMessage:         {"channel", "note", "velocity"},
+	NoteOffMessage:        {"channel", "note", "velocity"},
+	ProgramChangeMessage:  {"channel", "program"},
+	ControlChangeMessage:  {"channel", "controller", "value"},
+	PitchBendMessage:      {"channel", "bend"},
+	AfterTouchMessage:     {"channel", "pressure"},
+	PolyAfterTouchMessage: {"channel", "note", "pressure"},
+	SysExMessage:          {"sysex"},
+}
+
+// Get the fields of the OSC arguments of a message type.
+func oscFields(t MessageType) []string {
+	if fields, ok := oscArgumentFields[t]; ok {
+		return fields
+	}
+	return oscArgumentFields[NoteMessage]
+}
+
+// Make the default OSC arguments of a MIDI message, with the channel numbered from the channel base.
+func oscArguments(msg MQTTPayload) []interface{} {
+	var args []interface{}
+	for _, field := range oscFields(msg.Type) {
+		switch field {
+		case "channel":
+			args = append(args, int32(msg.displayChannel()))
+		case "note":
+			args = append(args, int32(msg.Note))
+		case "velocity":
+			args = append(args, int32(msg.Velocity))
+		case "program":
+			args = append(args, int32(msg.Program))
+		case "controller":
+			args = append(args, int32(msg.Controller))
+		case "value":
+			args = append(args, int32(msg.Value))
+		case "bend":
+			args = append(args, int32(msg.Bend))
+		case "pressure":
+			args = append(args, int32(msg.Pressure))
+		case "sysex":
+			args = append(args, msg.SysEx)
+		}
+	}
+	return args
+}
+
+// Type a rendered OSC argument, as an integer or float if it is a number, a boolean if true or false,
+// otherwise a string.
+func oscArgument(value string) interface{} {
+	if i, err := strconv.ParseInt(value, 10, 32); err == nil {
+		return int32(i)
+	}
+	if f, err := strconv.ParseFloat(value, 32); err == nil {
+		return float32(f)
+	}
+	if value == "true" || value == "false" {
+		return value == "true"
+	}
+	return value
+}
+
+// Update the message to the MIDI info of OSC arguments, in the order of the message type fields.
+func (p *MQTTPayload) ParseOSCArguments(args []interface{}) error {
+	fields := oscFields(p.Type)
+	if len(args) > len(fields) {
+		return fmt.Errorf("expected at most %d arguments of %s, got %d", len(fields), strings.Join(fields, ", "), len(args))
+	}
+	vars := make(map[string]string)
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case int32:
+			vars[fields[i]] = strconv.Itoa(int(v))
+		case int64:
+			vars[fields[i]] = strconv.FormatInt(v, 10)
+		case float32:
+			vars[fields[i]] = strconv.FormatFloat(float64(v), 'f', -1, 32)
+		case float64:
+			vars[fields[i]] = strconv.FormatFloat(v, 'f', -1, 64)
+		case string:
+			vars[fields[i]] = v
+		case []byte:
+			vars[fields[i]] = base64.StdEncoding.EncodeToString(v)
+		default:
+			return fmt.Errorf("unsupported %s argument: %v", fields[i], arg)
+		}
+	}
+	return p.ParseVars(vars)
+}
+
+// Send the OSC message of a trigger for a MIDI message.
+func (r *MidiRouter) sendTriggerOSC(trig *NoteTrigger, msg MQTTPayload, fields log.Fields) error {
+	data := NewTemplateData(msg)
+
+	// Render the address, which must be an OSC address.
+	address, err := renderTemplate(trig.oscAddressTemplate, trig.OscAddress, data)
+	if err != nil {
+		r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger failed to render osc address: %s", err)
+		return err
+	}
+	if !strings.HasPrefix(address, "/") {
+		r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger osc address does not start with /: %s", address)
+		return fmt.Errorf("address does not start with /: %s", address)
+	}
+
+	// Render the arguments if provided, otherwise send the MIDI info.
+	message := osc.NewMessage(address)
+	if len(trig.OscArguments) != 0 {
+		for i, arg := range trig.OscArguments {
+			// Templates which failed to parse are sent as the literal text.
+			var tmpl *template.Template
+			if i < len(trig.oscArgumentTemplates) {
+				tmpl = trig.oscArgumentTemplates[i]
+			}
+			value, err := renderTemplate(tmpl, arg, data)
+			if err != nil {
+				r.LogTrigger(trig.LogLevel, ErrorLog, fields, "Trigger failed to render osc argument %d: %s", i, err)
+				return err
+			}
+			message.Append(oscArgument(value))
+		}
+	} else {
+		message.Append(oscArguments(msg)...)
+	}
+
+	if r.DryRun {
+		r.LogTrigger(trig.LogLevel, InfoLog, log.Fields{"address": address}, "[DRY RUN] Would send OSC to %s: %s", r.OSC.SendAddress, message)
+		return nil
+	}
+	err = r.oscClient.Send(message)
+	if err != nil {
+		r.LogTrigger(trig.LogLevel, ErrorLog, log.Fields{"address": address}, "Trigger failed to send OSC to %s: %s", r.OSC.SendAddress, err)
+		return err
+	}
+	r.LogTrigger(trig.LogLevel, SendLog, log.Fields{"address": address}, "-> [OSC] %s", message)
+	return nil
+}
+
+// Handle OSC messages received.
+func (r *MidiRouter) OscOnMessage(message *osc.Message) {
+	if !r.beginWork() {
+		return
+	}
+	defer r.inFlight.Done()
+
+	fields := log.Fields{"address": message.Address}
+	r.LogWithFields(ReceiveLog, fields, "<- [OSC] %s", message)
+
+	// Check request triggers to see if one matches this address, which may be a pattern.
+	for _, t := range r.RequestTriggers {
+		if t.OscAddress == "" || !message.Match(t.OscAddress) {
+			continue
+		}
+
+		// If arguments allowed and provided, parse, otherwise use default payload.
+		arguments := t.Payload()
+		arguments.channelBase = r.ChannelDisplayBase
+		if !t.DisallowPayload && len(message.Arguments) != 0 {
+			err := arguments.ParseOSCArguments(message.Arguments)
+			if err != nil {
+				r.LogTrigger(t.LogLevel, ErrorLog, fields, "Invalid message: %s", err)
+				continue
+			}
+		}
+		r.fireRequestTrigger(&t, arguments, fields, "osc")
+	}
+
+	// Messages under the prefix send the MIDI message of the type named.
+	name, ok := strings.CutPrefix(message.Address, r.OSC.Prefix+"/")
+	if !ok {
+		return
+	}
+	if name == "panic" {
+		err := r.sendPanic()
+		if err != nil {
+			r.logSendError(fields, err)
+		}
+		return
+	}
+	msgType := MessageType(name)
+	if _, ok := oscArgumentFields[msgType]; !ok {
+		return
+	}
+	arguments := MQTTPayload{Type: msgType, channelBase: r.ChannelDisplayBase}
+	err := arguments.ParseOSCArguments(message.Arguments)
+	if err != nil {
+		r.LogWithFields(ErrorLog, fields, "Invalid message: %s", err)
+		return
+	}
+	err = r.sendMidi(arguments.MidiMessage())
+	if err != nil {
+		r.logSendError(fields, err)
+		return
+	}
+	r.LogWithFields(SendLog, arguments.Fields(), "-> [MIDI] %s", arguments)
+}
+
+// Set up the OSC client, and start listening for OSC messages, if configured.
+func (r *MidiRouter) connectOSC() {
+	if r.OSC.SendAddress != "" {
+		host, port, err := r.OSC.SendHostPort()
+		if err != nil {
+			r.Log(ErrorLog, "Invalid OSC send address '%s': %s", r.OSC.SendAddress, err)
+		} else {
+			r.oscClient = osc.NewClient(host, port)
+		}
+	}
+
+	if r.OSC.ListenAddress == "" {
+		return
+	}
+	conn, err := net.ListenPacket("udp", r.OSC.ListenAddress)
+	if err != nil {
+		r.Log(ErrorLog, "Failed to listen for OSC on %s: %s", r.OSC.ListenAddress, err)
+		return
+	}
+	r.oscConn = conn
+
+	dispatcher := osc.NewStandardDispatcher()
+	dispatcher.AddMsgHandler("*", r.OscOnMessage)
+	server := &osc.Server{Dispatcher: dispatcher}
+	go func() {
+		err := server.Serve(conn)
+		// Closing the connection on disconnect stops serving.
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			r.Log(ErrorLog, "OSC listener stopped: %s", err)
+		}
+	}()
+	r.Log(InfoLog, "Listening for OSC on %s", conn.LocalAddr())
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hypebeast/go-osc/osc"
+	"gitlab.com/gomidi/midi/v2"
+)
+
+func TestOscOnMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		triggers []RequestTrigger
+		message  *osc.Message
+		want     []midi.Message
+	}{
+		{
+			name:     "request trigger",
+			triggers: []RequestTrigger{{OscAddress: "/fire"}},
+			message:  osc.NewMessage("/fire", int32(1), int32(60), int32(100)),
+			want:     []midi.Message{midi.NoteOn(1, 60, 100)},
+		},
+		{
+			name:     "later request trigger after invalid arguments",
+			triggers: []RequestTrigger{{OscAddress: "/fire", MessageType: ProgramChangeMessage}, {OscAddress: "/fire"}},
+			message:  osc.NewMessage("/fire", int32(1), int32(60), int32(100)),
+			want:     []midi.Message{midi.NoteOn(1, 60, 100)},
+		},
+		{
+			name:     "prefix after invalid arguments",
+			triggers: []RequestTrigger{{OscAddress: "/midi/note", MessageType: ProgramChangeMessage}},
+			message:  osc.NewMessage("/midi/note", int32(1), int32(60), int32(100)),
+			want:     []midi.Message{midi.NoteOn(1, 60, 100)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &fakeOutPort{name: "out"}
+			r := &MidiRouter{MidiOut: out, OSC: OSCConfig{Prefix: "/midi"}, RequestTriggers: tt.triggers}
+			r.OscOnMessage(tt.message)
+			assertSent(t, out, tt.want...)
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"gitlab.com/gomidi/midi/v2"
+)
+
+// Controllers of the channel mode messages sent to silence a device.
+const (
+	allSoundOffController = 120
+	allNotesOffController = 123
+)
+
+// Send all notes off on every channel, and all sound off if configured, to silence hanging notes.
+func (r *MidiRouter) sendPanic() error {
+	var msgs []midi.Message
+	for ch := uint8(0); ch < 16; ch++ {
+		if r.PanicAllSoundOff {
+			msgs = append(msgs, midi.ControlChange(ch, allSoundOffController, 0))
+		}
+		msgs = append(msgs, midi.ControlChange(ch, allNotesOffController, 0))
+	}
+	for _, msg := range msgs {
+		err := r.sendMidi(msg)
+		if err != nil {
+			return err
+		}
+	}
+	r.Log(SendLog, "-> [MIDI] Panic, all notes off on all channels")
+	return nil
+}
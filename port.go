@@ -0,0 +1,83 @@
+package main
+
+import (
+	"gitlab.com/gomidi/midi/v2"
+	"gitlab.com/gomidi/midi/v2/drivers"
+)
+
+// A MIDI output which the router sends messages to.
+// Routers depend on this rather than the driver, so the device may be replaced with a fake.
+type MidiOutPort interface {
+	String() string
+	Open() error
+	Send(msg midi.Message) error
+}
+
+// A MIDI input which the router receives messages from.
+type MidiInPort interface {
+	String() string
+	Open() error
+	Listen(recv func(msg midi.Message, timestampms int32), opts ...midi.Option) (stop func(), err error)
+}
+
+// An output port of the MIDI driver.
+type driverOutPort struct {
+	out drivers.Out
+}
+
+// Name of the output device.
+func (p driverOutPort) String() string {
+	return p.out.String()
+}
+
+// Open the output device, which may already be open.
+func (p driverOutPort) Open() error {
+	return p.out.Open()
+}
+
+// Send a message to the output device.
+func (p driverOutPort) Send(msg midi.Message) error {
+	send, err := midi.SendTo(p.out)
+	if err != nil {
+		return err
+	}
+	return send(msg)
+}
+
+// An input port of the MIDI driver.
+type driverInPort struct {
+	in drivers.In
+}
+
+// Name of the input device.
+func (p driverInPort) String() string {
+	return p.in.String()
+}
+
+// Open the input device, which may already be open.
+func (p driverInPort) Open() error {
+	return p.in.Open()
+}
+
+// Listen to messages from the input device until stopped.
+func (p driverInPort) Listen(recv func(msg midi.Message, timestampms int32), opts ...midi.Option) (func(), error) {
+	return midi.ListenTo(p.in, recv, opts...)
+}
+
+// List the input ports of the MIDI driver, replaced in tests with fake ports.
+var listInPorts = func() []MidiInPort {
+	var ports []MidiInPort
+	for _, in := range midi.GetInPorts() {
+		ports = append(ports, driverInPort{in})
+	}
+	return ports
+}
+
+// List the output ports of the MIDI driver, replaced in tests with fake ports.
+var listOutPorts = func() []MidiOutPort {
+	var ports []MidiOutPort
+	for _, out := range midi.GetOutPorts() {
+		ports = append(ports, driverOutPort{out})
+	}
+	return ports
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"gitlab.com/gomidi/midi/v2"
+)
+
+// An output port which records the messages sent to it.
+type fakeOutPort struct {
+	name string
+	mu   sync.Mutex
+	sent []midi.Message
+}
+
+func (p *fakeOutPort) String() string {
+	return p.name
+}
+
+func (p *fakeOutPort) Open() error {
+	return nil
+}
+
+func (p *fakeOutPort) Send(msg midi.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = append(p.sent, append(midi.Message(nil), msg...))
+	return nil
+}
+
+// Get the messages sent to the port.
+func (p *fakeOutPort) Sent() []midi.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]midi.Message(nil), p.sent...)
+}
+
+// An input port which messages are injected into, as if received from a device.
+type fakeInPort struct {
+	name string
+	mu   sync.Mutex
+	recv func(msg midi.Message, timestampms int32)
+}
+
+func (p *fakeInPort) String() string {
+	return p.name
+}
+
+func (p *fakeInPort) Open() error {
+	return nil
+}
+
+func (p *fakeInPort) Listen(recv func(msg midi.Message, timestampms int32), opts ...midi.Option) (func(), error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.recv = recv
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.recv = nil
+	}, nil
+}
+
+// Check if the port is being listened to.
+func (p *fakeInPort) Listening() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.recv != nil
+}
+
+// Send a message to the listener, returning false if the port is not listened to.
+func (p *fakeInPort) Inject(msg midi.Message) bool {
+	p.mu.Lock()
+	recv := p.recv
+	p.mu.Unlock()
+	if recv == nil {
+		return false
+	}
+	recv(msg, 0)
+	return true
+}
+
+// Devices available to routers, which tests may add and remove while routers are connected.
+type fakeDevices struct {
+	mu   sync.Mutex
+	ins  []MidiInPort
+	outs []MidiOutPort
+}
+
+// Replace the ports of the MIDI driver with the fake devices for the test.
+func useFakeDevices(t *testing.T) *fakeDevices {
+	d := new(fakeDevices)
+	oldIns, oldOuts := listInPorts, listOutPorts
+	listInPorts = func() []MidiInPort {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return append([]MidiInPort(nil), d.ins...)
+	}
+	listOutPorts = func() []MidiOutPort {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return append([]MidiOutPort(nil), d.outs...)
+	}
+	t.Cleanup(func() {
+		listInPorts, listOutPorts = oldIns, oldOuts
+	})
+	return d
+}
+
+// Make the ports of a device available.
+func (d *fakeDevices) Add(in *fakeInPort, out *fakeOutPort) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if in != nil {
+		d.ins = append(d.ins, in)
+	}
+	if out != nil {
+		d.outs = append(d.outs, out)
+	}
+}
+
+// Remove all devices, as if unplugged.
+func (d *fakeDevices) RemoveAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ins = nil
+	d.outs = nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimited(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		want  []int
+	}{
+		{
+			name: "unlimited",
+			want: []int{http.StatusNoContent, http.StatusNoContent, http.StatusNoContent, http.StatusNoContent},
+		},
+		{
+			name:  "burst",
+			rate:  0.001,
+			burst: 3,
+			want:  []int{http.StatusNoContent, http.StatusNoContent, http.StatusNoContent, http.StatusTooManyRequests},
+		},
+		{
+			name: "burst defaults to rate",
+			rate: 1.5,
+			want: []int{http.StatusNoContent, http.StatusNoContent, http.StatusTooManyRequests},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := new(HTTPServer)
+			if tt.rate > 0 {
+				s.limiter = newRateLimiter(tt.rate, tt.burst)
+			}
+			handler := s.rateLimited(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			// Each request of the burst is sent before the bucket refills.
+			for i, status := range tt.want {
+				w := httptest.NewRecorder()
+				handler(w, httptest.NewRequest(http.MethodGet, "/note", nil))
+				if w.Code != status {
+					t.Errorf("request %d status %d, want %d", i+1, w.Code, status)
+				}
+				if status == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+					t.Errorf("request %d without retry after", i+1)
+				}
+			}
+		})
+	}
+}
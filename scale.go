@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Maximum value of 7 bit MIDI values, such as velocity.
+const maxMidiValue = 127
+
+// Scales velocity between the MIDI range and another range, such as 0 to 100 for an API.
+// Scaled values are clamped to the valid MIDI range of 0 to 127.
+type VelocityScale struct {
+	// Curve applied to the velocity, either linear, exponential, or inverted.
+	Curve string `fig:"curve"`
+	// Range the velocity is scaled to, defaulting to 0 to 127.
+	Min uint8 `fig:"min"`
+	Max uint8 `fig:"max"`
+}
+
+// Check if the scale is valid.
+func (s VelocityScale) Validate() error {
+	switch s.Curve {
+	case "", "linear", "exponential", "inverted":
+	default:
+		return fmt.Errorf("unknown velocity curve: %s", s.Curve)
+	}
+	if s.Min > maxMidiValue || s.Max > maxMidiValue {
+		return fmt.Errorf("velocity scale range must be within 0 to %d", maxMidiValue)
+	}
+	return nil
+}
+
+// Get the range scaled to, defaulting to the full MIDI range.
+func (s VelocityScale) bounds() (float64, float64) {
+	if s.Min == 0 && s.Max == 0 {
+		return 0, maxMidiValue
+	}
+	return float64(s.Min), float64(s.Max)
+}
+
+// Clamp a value to the MIDI range.
+func clampMidiValue(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(maxMidiValue, math.Round(v))))
+}
+
+// Scale a MIDI velocity to the range.
+func (s VelocityScale) Scale(velocity uint8) uint8 {
+	x := float64(velocity) / maxMidiValue
+	switch s.Curve {
+	case "exponential":
+		x = x * x
+	case "inverted":
+		x = 1 - x
+	}
+	min, max := s.bounds()
+	return clampMidiValue(min + x*(max-min))
+}
+
+// Scale a velocity in the range back to the MIDI range.
+func (s VelocityScale) Unscale(velocity uint8) uint8 {
+	min, max := s.bounds()
+	if min == max {
+		return velocity
+	}
+	x := math.Max(0, math.Min(1, (float64(velocity)-min)/(max-min)))
+	switch s.Curve {
+	case "exponential":
+		x = math.Sqrt(x)
+	case "inverted":
+		x = 1 - x
+	}
+	return clampMidiValue(x * maxMidiValue)
+}
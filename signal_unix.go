@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signal to reload only the log configuration.
+var reloadLogSignals = []os.Signal{syscall.SIGUSR1}
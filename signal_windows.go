@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// Windows has no user signal, so the log configuration is only reloaded with the full configuration.
+var reloadLogSignals []os.Signal
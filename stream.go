@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Number of events buffered for each subscriber before events are dropped.
+const subscriberBufferSize = 100
+
+// How long to wait on a slow client when writing to a stream.
+const streamWriteTimeout = 10 * time.Second
+
+// Subscribe to the MIDI messages received, returning a function to unsubscribe.
+func (r *MidiRouter) Subscribe() (<-chan FirehoseMessage, func()) {
+	ch := make(chan FirehoseMessage, subscriberBufferSize)
+	r.subscribersMu.Lock()
+	if r.subscribers == nil {
+		r.subscribers = make(map[chan FirehoseMessage]struct{})
+	}
+	r.subscribers[ch] = struct{}{}
+	r.subscribersMu.Unlock()
+
+	return ch, func() {
+		r.subscribersMu.Lock()
+		delete(r.subscribers, ch)
+		r.subscribersMu.Unlock()
+	}
+}
+
+// Send a MIDI message received to each subscriber, dropping it for subscribers which are behind.
+func (r *MidiRouter) publishSubscribers(msg MQTTPayload) {
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+	if len(r.subscribers) == 0 {
+		return
+	}
+
+	event := FirehoseMessage{MQTTPayload: msg}
+	for ch := range r.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subprotocol of the WebSocket stream, which browsers request along with the API key subprotocol.
+const streamProtocol = "midi-request-trigger"
+
+// Upgrades requests to WebSocket connections.
+var upgrader = websocket.Upgrader{Subprotocols: []string{streamProtocol}}
+
+// Streams the MIDI messages received by a router as JSON WebSocket messages.
+func (s *HTTPServer) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	router := findRouter(mux.Vars(r)["router"])
+	if router == nil {
+		http.Error(w, "router not found", http.StatusNotFound)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already responded with the error.
+		return
+	}
+	defer conn.Close()
+
+	events, unsubscribe := router.Subscribe()
+	defer unsubscribe()
+
+	// Read until the client disconnects, as messages from the client are not used.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Send events until the client disconnects.
+	for {
+		select {
+		case event := <-events:
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// Streams the MIDI messages received by a router as JSON server-sent events.
+func (s *HTTPServer) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	router := findRouter(mux.Vars(r)["router"])
+	if router == nil {
+		http.Error(w, "router not found", http.StatusNotFound)
+		return
+	}
+
+	events, unsubscribe := router.Subscribe()
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	// Send events until the client disconnects.
+	for {
+		select {
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Maximum size of system exclusive messages received or sent.
+const maxSysExSize = 4096
+
+// Decode system exclusive bytes from hex, such as `43 10 4C`, as written in the config.
+// The start and end bytes are added when sent, so they should not be included.
+func decodeSysExHex(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		return nil, fmt.Errorf("sysex is not valid hex")
+	}
+	return b, checkSysEx(b)
+}
+
+// Decode system exclusive bytes from base64, as encoded in JSON and the requests of note triggers,
+// so values sent by triggers are received unchanged.
+func decodeSysExBase64(s string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("sysex is not valid base64")
+	}
+	return b, checkSysEx(b)
+}
+
+// Check system exclusive bytes are within the maximum size, and are data bytes,
+// as a status byte such as the end byte would cut the message short.
+func checkSysEx(b []byte) error {
+	if len(b) > maxSysExSize {
+		return fmt.Errorf("sysex is %d bytes, larger than the maximum of %d", len(b), maxSysExSize)
+	}
+	for i, v := range b {
+		if v > maxMidiValue {
+			return fmt.Errorf("sysex byte %d is %02X, above the data byte maximum of 7F", i, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+)
+
+func TestDecodeSysEx(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func(string) ([]byte, error)
+		value  string
+		want   []byte
+		err    bool
+	}{
+		{name: "hex", decode: decodeSysExHex, value: "43 10 4C", want: []byte{0x43, 0x10, 0x4C}},
+		{name: "hex without spaces", decode: decodeSysExHex, value: "7F00", want: []byte{0x7F, 0x00}},
+		{name: "hex end byte", decode: decodeSysExHex, value: "43 F7 10", err: true},
+		{name: "base64", decode: decodeSysExBase64, value: "QxBM", want: []byte{0x43, 0x10, 0x4C}},
+		{name: "base64 of hex characters", decode: decodeSysExBase64, value: "ABAD", want: []byte{0x00, 0x10, 0x03}},
+		{name: "base64 status byte", decode: decodeSysExBase64, value: "ABCD", err: true},
+		{name: "invalid base64", decode: decodeSysExBase64, value: "43 10", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.decode(tt.value)
+			if tt.err {
+				if err == nil {
+					t.Errorf("decoded %X without error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("decoded %X, want %X", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSysExQueryRoundTrip(t *testing.T) {
+	srv, queries := newQueryServer(t)
+	r := &MidiRouter{}
+
+	// The query of trigger requests is parsed back to the same bytes, even when the base64 is all hex characters.
+	for _, sysex := range [][]byte{{0x43, 0x10, 0x4C}, {0x00, 0x10, 0x03}} {
+		r.runTrigger(&NoteTrigger{URL: srv.URL, MidiInfoInRequest: true}, MQTTPayload{Type: SysExMessage, SysEx: sysex})
+		values, err := url.ParseQuery(<-queries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := MQTTPayload{Type: SysExMessage}
+		if err := received.ParseValues(values); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received.SysEx, sysex) {
+			t.Errorf("received %X, want %X", received.SysEx, sysex)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"text/template"
+
+	"gitlab.com/gomidi/midi/v2"
+)
+
+// Values available to templates rendered for a MIDI message.
+type TemplateData struct {
+	MQTTPayload
+	// Name of the note, such as C4.
+	NoteName string
+}
+
+// Make the template values for a MIDI message.
+func NewTemplateData(msg MQTTPayload) TemplateData {
+	return TemplateData{
+		MQTTPayload: msg,
+		NoteName:    midi.Note(msg.Note).String(),
+	}
+}
+
+// Parse a template, returning nil if the text has no template actions.
+func parseTemplate(name, text string) (*template.Template, error) {
+	if !strings.Contains(text, "{{") {
+		return nil, nil
+	}
+	return template.New(name).Parse(text)
+}
+
+// Render a template with the values, using the literal text if there is no template.
+func renderTemplate(tmpl *template.Template, text string, data TemplateData) (string, error) {
+	if tmpl == nil {
+		return text, nil
+	}
+	var b strings.Builder
+	err := tmpl.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Parse the templates of strings within a payload, keyed by the template text.
+func parsePayloadTemplates(payload interface{}, templates map[string]*template.Template) error {
+	switch v := payload.(type) {
+	case string:
+		tmpl, err := parseTemplate("payload", v)
+		if err != nil {
+			return err
+		}
+		if tmpl != nil {
+			templates[v] = tmpl
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			if err := parsePayloadTemplates(item, templates); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := parsePayloadTemplates(item, templates); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Render the templates of strings within a payload, returning a copy of the payload.
+func renderPayload(payload interface{}, templates map[string]*template.Template, data TemplateData) (interface{}, error) {
+	switch v := payload.(type) {
+	case string:
+		return renderTemplate(templates[v], v, data)
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			value, err := renderPayload(item, templates, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[key] = value
+		}
+		return rendered, nil
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, item := range v {
+			value, err := renderPayload(item, templates, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[i] = value
+		}
+		return rendered, nil
+	}
+	return payload, nil
+}
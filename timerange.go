@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Range of the time of day in local time, such as 08:00-22:00, which may cross midnight, such as 22:00-06:00.
+type TimeRange struct {
+	// Minutes after midnight the range starts, inclusive, and ends, exclusive.
+	Start int
+	End   int
+}
+
+// Parse a time of day, such as 08:00, into minutes after midnight.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %q, expected a time such as 08:00", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Parse a time range from the config.
+func (r *TimeRange) UnmarshalString(s string) error {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return fmt.Errorf("invalid time range: %q, expected a range such as 08:00-22:00", s)
+	}
+	var err error
+	r.Start, err = parseTimeOfDay(start)
+	if err != nil {
+		return err
+	}
+	r.End, err = parseTimeOfDay(end)
+	return err
+}
+
+// Provides the range as configured.
+func (r TimeRange) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", r.Start/60, r.Start%60, r.End/60, r.End%60)
+}
+
+// Encode the range as configured.
+func (r TimeRange) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// Check if the time of day is within the range, with a range starting and ending at the same time being all day.
+func (r TimeRange) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if r.Start <= r.End {
+		return r.Start == r.End || (m >= r.Start && m < r.End)
+	}
+	return m >= r.Start || m < r.End
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/gomidi/midi/v2"
+)
+
+// Timing clock messages sent per quarter note.
+const clocksPerBeat = 24
+
+// Payload of clock and transport messages.
+type TransportPayload struct {
+	// Either clock, start, stop, or continue.
+	Type string `json:"type"`
+	// Beats counted since the last start, for clock messages.
+	Beat uint64 `json:"beat,omitempty"`
+	// Tempo measured from the last beat, for clock messages.
+	BPM float64 `json:"bpm,omitempty"`
+}
+
+// Publish a clock or transport message to the transport topic.
+func (r *MidiRouter) publishTransport(payload TransportPayload) {
+	if r.mqttClient() == nil {
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		r.Log(ErrorLog, "Json Encode: %s", err)
+		return
+	}
+	topic := r.MQTT.Topic + "/transport"
+	r.mqttPublish(topic, r.MQTT.QoS, false, data)
+	r.LogWithFields(SendLog, log.Fields{"topic": topic}, "-> [MQTT] %s: %s", topic, string(data))
+}
+
+// Count timing clock messages, publishing once per beat to avoid flooding the broker.
+func (r *MidiRouter) handleClock() {
+	r.clockTicks++
+	if r.clockTicks%clocksPerBeat != 0 {
+		return
+	}
+
+	// Measure the tempo from the time since the last beat.
+	now := time.Now()
+	payload := TransportPayload{
+		Type: "clock",
+		Beat: r.clockTicks / clocksPerBeat,
+	}
+	if !r.clockBeat.IsZero() {
+		payload.BPM = time.Minute.Seconds() / now.Sub(r.clockBeat).Seconds()
+	}
+	r.clockBeat = now
+	r.publishTransport(payload)
+}
+
+// Handle transport messages, resetting the clock count on start.
+func (r *MidiRouter) handleTransport(transport string) {
+	r.Log(ReceiveLog, "transport %s", transport)
+	if transport == "start" {
+		r.clockTicks = 0
+		r.clockBeat = time.Time{}
+	}
+	r.publishTransport(TransportPayload{Type: transport})
+}
+
+// Make the MIDI message for a transport name.
+func transportMessage(transport string) (midi.Message, error) {
+	switch transport {
+	case "start":
+		return midi.Start(), nil
+	case "stop":
+		return midi.Stop(), nil
+	case "continue":
+		return midi.Continue(), nil
+	}
+	return nil, fmt.Errorf("unknown transport: %s", transport)
+}
+
+// Send a transport message received over MQTT, either as JSON or the plain name.
+func (r *MidiRouter) sendTransport(payload []byte) {
+	var arguments TransportPayload
+	err := json.Unmarshal(payload, &arguments)
+	if err != nil {
+		arguments.Type = strings.TrimSpace(string(payload))
+	}
+
+	msg, err := transportMessage(arguments.Type)
+	if err != nil {
+		r.Log(ErrorLog, "Failed to send transport: %s", err)
+		return
+	}
+
+	// Send MIDI message.
+	err = r.sendMidi(msg)
+	if err != nil {
+		r.logSendError(log.Fields{"transport": arguments.Type}, err)
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// Static files of the web UI.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// Serves the web UI for testing request triggers and watching the MIDI messages received.
+func (s *HTTPServer) UIHandler() http.Handler {
+	files, _ := fs.Sub(uiFiles, "ui")
+	return http.StripPrefix("/ui", http.FileServer(http.FS(files)))
+}
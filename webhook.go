@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Webhook which receives every MIDI message received, similar to the MQTT firehose.
+type FirehoseWebhook struct {
+	// URL to POST messages to as JSON.
+	URL string `fig:"url"`
+	// Headers to add to the request.
+	Headers http.Header `fig:"headers"`
+	// Send messages in batches as a JSON array at this interval,
+	// instead of a request for each message.
+	FlushInterval time.Duration `fig:"flush_interval"`
+	// Timeout for the request.
+	Timeout time.Duration `fig:"timeout" default:"30s"`
+	// If the URL uses TLS, should it verify the certificate.
+	InsecureSkipVerify bool `fig:"insecure_skip_verify"`
+}
+
+// Encode the webhook with the credential headers redacted.
+func (w FirehoseWebhook) MarshalJSON() ([]byte, error) {
+	type webhook FirehoseWebhook
+	w.Headers = redactHeader(w.Headers)
+	return json.Marshal(webhook(w))
+}
+
+// Message sent to the firehose webhook, including the timestamp it was received.
+type FirehoseMessage struct {
+	MQTTPayload
+}
+
+// Queue a message for the firehose webhook, dropping it if the queue is full.
+func (r *MidiRouter) queueFirehoseWebhook(msg MQTTPayload) {
+	if r.webhookQueue == nil {
+		return
+	}
+
+	select {
+	case r.webhookQueue <- FirehoseMessage{MQTTPayload: msg}:
+	default:
+		r.Log(ErrorLog, "Firehose webhook queue is full, dropping message: %s", msg)
+	}
+}
+
+// Send queued messages to the firehose webhook, batching if a flush interval is set.
+func (r *MidiRouter) firehoseWebhookWorker(queue chan FirehoseMessage) {
+	// Without a flush interval, send each message as it is received.
+	if r.FirehoseWebhook.FlushInterval <= 0 {
+		for msg := range queue {
+			r.postFirehoseWebhook(msg)
+		}
+		return
+	}
+
+	// Collect messages, and send them on each interval.
+	ticker := time.NewTicker(r.FirehoseWebhook.FlushInterval)
+	defer ticker.Stop()
+	var batch []FirehoseMessage
+	for {
+		select {
+		case msg, ok := <-queue:
+			if !ok {
+				// Send the remaining messages before stopping.
+				if len(batch) != 0 {
+					r.postFirehoseWebhook(batch)
+				}
+				return
+			}
+			batch = append(batch, msg)
+		case <-ticker.C:
+			if len(batch) != 0 {
+				r.postFirehoseWebhook(batch)
+				batch = nil
+			}
+		}
+	}
+}
+
+// POST a message, or batch of messages, to the firehose webhook.
+func (r *MidiRouter) postFirehoseWebhook(payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		r.Log(ErrorLog, "Json Encode: %s", err)
+		r.recordResult("webhook", err)
+		return
+	}
+	fields := log.Fields{"url": r.FirehoseWebhook.URL}
+
+	// In dry run mode, log the request instead of sending it.
+	if r.DryRun {
+		r.LogWithFields(InfoLog, fields, "[DRY RUN] Would request POST %s: %s", r.FirehoseWebhook.URL, string(data))
+		r.recordResult("webhook", nil)
+		return
+	}
+
+	// Make the request.
+	req, err := http.NewRequest(http.MethodPost, r.FirehoseWebhook.URL, bytes.NewReader(data))
+	if err != nil {
+		r.LogWithFields(ErrorLog, fields, "Firehose webhook failed to make request: %s", err)
+		r.recordResult("webhook", err)
+		return
+	}
+	req.Header = copyHeader(r.FirehoseWebhook.Headers)
+	req.Header.Set("Content-Type", "application/json")
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	// Perform the request with the shared client.
+	client := r.httpClient(httpClientKey{
+		InsecureSkipVerify: r.FirehoseWebhook.InsecureSkipVerify,
+		Timeout:            r.FirehoseWebhook.Timeout,
+	})
+	res, err := client.Do(req)
+	if err != nil {
+		httpRequestsTotal.WithLabelValues(r.Name, "error").Inc()
+		r.LogWithFields(ErrorLog, fields, "Firehose webhook failed to request: %s", err)
+		r.recordResult("webhook", err)
+		return
+	}
+	// Drain and close the body so the connection can be reused.
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	httpRequestsTotal.WithLabelValues(r.Name, strconv.Itoa(res.StatusCode)).Inc()
+	if res.StatusCode >= 400 {
+		r.LogWithFields(ErrorLog, fields, "Firehose webhook server responded with %s", res.Status)
+		r.recordResult("webhook", fmt.Errorf("server responded with %s", res.Status))
+		return
+	}
+	r.LogWithFields(SendLog, fields, "-> [HTTP] %s: %s", r.FirehoseWebhook.URL, string(data))
+	r.recordResult("webhook", nil)
+}
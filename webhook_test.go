@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.com/gomidi/midi/v2"
+)
+
+func TestFirehoseWebhookControlChange(t *testing.T) {
+	bodies := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		bodies <- body
+	}))
+	defer srv.Close()
+	devices := useFakeDevices(t)
+	in := &fakeInPort{name: "keys in"}
+	devices.Add(in, nil)
+	r := &MidiRouter{Device: "keys", FirehoseWebhook: FirehoseWebhook{URL: srv.URL}}
+	r.Connect()
+	defer r.Disconnect()
+	waitFor(t, "connection", in.Listening)
+
+	// Control changes received are sent with their controller and value, including a value of 0.
+	in.Inject(midi.ControlChange(2, 7, 0))
+	select {
+	case body := <-bodies:
+		var got map[string]interface{}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]interface{}{"type": "control_change", "channel": 2.0, "controller": 7.0, "value": 0.0}
+		for key, value := range want {
+			if got[key] != value {
+				t.Errorf("%s is %v, want %v in %s", key, got[key], value, body)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the webhook")
+	}
+}